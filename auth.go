@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"strings"
+)
+
+const tokenParam string = "token"
+
+// BotConfig lets a chat bot call the external commands. The bot passes
+// Token as ?token= or an "Authorization: Bearer" header.
+type BotConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Channels the bot may act on. Empty means every channel.
+	Channels []string `json:"channels"`
+}
+
+func (b BotConfig) allowed(channel string) bool {
+	if len(b.Channels) == 0 {
+		return true
+	}
+	for _, c := range b.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBots(bots []BotConfig, channels []ChannelConfig) error {
+	known := make(map[string]bool)
+	for _, c := range channels {
+		known[c.Name] = true
+	}
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, b := range bots {
+		if b.Name == "" {
+			return errors.New("bot without a name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("duplicate bot %q", b.Name)
+		}
+		names[b.Name] = true
+		if b.Token == "" {
+			return fmt.Errorf("bot %q has no token", b.Name)
+		}
+		if tokens[b.Token] {
+			return fmt.Errorf("bot %q shares its token with another bot", b.Name)
+		}
+		tokens[b.Token] = true
+		for _, c := range b.Channels {
+			if !known[c] {
+				return fmt.Errorf("bot %q is for unknown channel %q", b.Name, c)
+			}
+		}
+	}
+	return nil
+}
+
+func requestToken(ctx *gin.Context) string {
+	if h := ctx.Request.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ctx.Query(tokenParam)
+}
+
+// botFor returns the bot with token, if there is one.
+func botFor(token string) (BotConfig, bool) {
+	for _, b := range config.Bots {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(b.Token)) == 1 {
+			return b, true
+		}
+	}
+	return BotConfig{}, false
+}
+
+// requireBot only lets configured bots through, and only to their own
+// channels. It has to run after withChannel.
+func requireBot(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	token := requestToken(ctx)
+	if token == "" {
+		ctx.String(401, "This command needs a bot token.")
+		ctx.Abort()
+		return
+	}
+	bot, ok := botFor(token)
+	if !ok {
+		log.Printf("auth: rejected %s with an unknown token", ctx.Request.URL.Path)
+		ctx.String(401, "This command needs a valid bot token.")
+		ctx.Abort()
+		return
+	}
+	if !bot.allowed(ch.Name) {
+		log.Printf("auth: rejected bot %s on channel %s", bot.Name, ch.Name)
+		ctx.String(403, bot.Name+" may not send commands for "+ch.Name+".")
+		ctx.Abort()
+		return
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Banner is a time-limited event. Featured cards are more likely to be
+// rolled within their tier, and exclusive cards can only be rolled while
+// a banner listing them is running.
+type Banner struct {
+	Name      string     `json:"name"`
+	Title     string     `json:"title"`
+	Start     time.Time  `json:"start"`
+	End       time.Time  `json:"end"`
+	Featured  []Featured `json:"featured"`
+	Exclusive []int      `json:"exclusive"`
+}
+
+type Featured struct {
+	Id int `json:"id"`
+	// RateUp multiplies the card's weight within its tier.
+	RateUp float64 `json:"rate_up"`
+}
+
+func (b Banner) active(now time.Time) bool {
+	return !now.Before(b.Start) && now.Before(b.End)
+}
+
+// weight is the relative weight of card id within its tier pool.
+func (b Banner) weight(id int) float64 {
+	for _, f := range b.Featured {
+		if f.Id == id {
+			return f.RateUp
+		}
+	}
+	return 1
+}
+
+func validateBanners(banners []Banner) error {
+	seen := make(map[string]bool)
+	for _, b := range banners {
+		if b.Name == "" {
+			return errors.New("banner without a name")
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("duplicate banner %q", b.Name)
+		}
+		seen[b.Name] = true
+		if !b.End.After(b.Start) {
+			return fmt.Errorf("banner %q ends before it starts", b.Name)
+		}
+		for _, f := range b.Featured {
+			if f.RateUp <= 0 {
+				return fmt.Errorf("banner %q: card %d needs a positive rate_up", b.Name, f.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// exclusiveIds is every card that is exclusive to at least one banner.
+func exclusiveIds(banners []Banner) map[int]bool {
+	ret := make(map[int]bool)
+	for _, b := range banners {
+		for _, id := range b.Exclusive {
+			ret[id] = true
+		}
+	}
+	return ret
+}
+
+func activeBanners(now time.Time) (ret []*Banner) {
+	for i := range config.Banners {
+		if config.Banners[i].active(now) {
+			ret = append(ret, &config.Banners[i])
+		}
+	}
+	return ret
+}
+
+// pickBanner returns the active banner called name, or the first active
+// banner if name is empty. The banner is nil when nothing is running, and
+// ok is false only when a named banner is not running.
+func pickBanner(name string, now time.Time) (banner *Banner, ok bool) {
+	active := activeBanners(now)
+	if name == "" {
+		if len(active) == 0 {
+			return nil, true
+		}
+		return active[0], true
+	}
+	for _, b := range active {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// findBanner returns the configured banner called name, running or not.
+func findBanner(name string) (*Banner, bool) {
+	for i := range config.Banners {
+		if config.Banners[i].Name == name {
+			return &config.Banners[i], true
+		}
+	}
+	return nil, false
+}
+
+// upcomingBanners returns the banners that have not started yet, soonest
+// first.
+func upcomingBanners(now time.Time) (ret []*Banner) {
+	for i := range config.Banners {
+		if now.Before(config.Banners[i].Start) {
+			ret = append(ret, &config.Banners[i])
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Start.Before(ret[j].Start) })
+	return ret
+}
+
+// formatBanners lists the running banners and then the scheduled ones with
+// their start times in UTC.
+func formatBanners(now time.Time) string {
+	active := activeBanners(now)
+	upcoming := upcomingBanners(now)
+	if len(active) == 0 && len(upcoming) == 0 {
+		return "No banners are running right now."
+	}
+	var ret []string
+	if len(active) > 0 {
+		parts := make([]string, len(active))
+		for i, b := range active {
+			parts[i] = fmt.Sprintf("%s [%s] ends in %s", b.Title, b.Name, b.End.Sub(now).Truncate(time.Minute))
+		}
+		ret = append(ret, "Banners: "+strings.Join(parts, ", ")+".")
+	}
+	if len(upcoming) > 0 {
+		parts := make([]string, len(upcoming))
+		for i, b := range upcoming {
+			parts[i] = fmt.Sprintf("%s [%s] starts %s UTC, in %s", b.Title, b.Name, b.Start.UTC().Format("Jan 2 15:04"), b.Start.Sub(now).Truncate(time.Minute))
+		}
+		ret = append(ret, "Coming up: "+strings.Join(parts, ", ")+".")
+	}
+	return strings.Join(ret, " ")
+}
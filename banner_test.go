@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatBannersListsScheduledBanners(t *testing.T) {
+	newTestChannel(t, newMemStore())
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	if got := formatBanners(now); got != "No banners are running right now." {
+		t.Errorf("without banners: %q", got)
+	}
+
+	config.Banners = []Banner{
+		{Name: "late", Title: "Late", Start: now.Add(48 * time.Hour), End: now.Add(72 * time.Hour)},
+		{Name: "soon", Title: "Soon", Start: now.Add(3 * time.Hour), End: now.Add(24 * time.Hour)},
+		{Name: "past", Title: "Past", Start: now.Add(-48 * time.Hour), End: now.Add(-24 * time.Hour)},
+	}
+	want := "Coming up: Soon [soon] starts Oct 18 15:00 UTC, in 3h0m0s, Late [late] starts Oct 20 12:00 UTC, in 48h0m0s."
+	if got := formatBanners(now); got != want {
+		t.Errorf("with only scheduled banners:\n got %q\nwant %q", got, want)
+	}
+
+	config.Banners = append(config.Banners, Banner{Name: "now", Title: "Now", Start: now.Add(-time.Hour), End: now.Add(2 * time.Hour)})
+	want = "Banners: Now [now] ends in 2h0m0s. " + want
+	if got := formatBanners(now); got != want {
+		t.Errorf("with running and scheduled banners:\n got %q\nwant %q", got, want)
+	}
+}
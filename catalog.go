@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CatalogSource is somewhere the full monster list can be loaded from.
+type CatalogSource interface {
+	Name() string
+	Load() ([]Card, error)
+}
+
+type httpCatalogSource struct {
+	url    string
+	client *http.Client
+}
+
+func newHttpCatalogSource(url string, timeout time.Duration) httpCatalogSource {
+	return httpCatalogSource{url, &http.Client{Timeout: timeout}}
+}
+
+func (s httpCatalogSource) Name() string {
+	return s.url
+}
+
+func (s httpCatalogSource) Load() ([]Card, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return decodeCards(resp.Body)
+}
+
+type fileCatalogSource struct {
+	path string
+}
+
+func (s fileCatalogSource) Name() string {
+	return s.path
+}
+
+func (s fileCatalogSource) Load() ([]Card, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeCards(f)
+}
+
+// snapshotCatalogSource is the last catalog from any other source that
+// passed validation.
+type snapshotCatalogSource struct {
+	fileCatalogSource
+}
+
+func (s snapshotCatalogSource) Name() string {
+	return "snapshot " + s.path
+}
+
+func (s snapshotCatalogSource) save(cards []Card) error {
+	b, err := json.Marshal(cards)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func decodeCards(r io.Reader) ([]Card, error) {
+	var allCards []Card
+	err := json.NewDecoder(r).Decode(&allCards)
+	if err != nil {
+		return nil, err
+	}
+	if len(allCards) == 0 {
+		return nil, errors.New("catalog is empty")
+	}
+	return allCards, nil
+}
+
+func catalogSources(c CatalogConfig) (sources []CatalogSource) {
+	if c.File != "" {
+		sources = append(sources, fileCatalogSource{c.File})
+	}
+	if !c.Offline && c.URL != "" {
+		sources = append(sources, newHttpCatalogSource(c.URL, c.Timeout.Duration))
+	}
+	if c.Snapshot != "" {
+		sources = append(sources, snapshotCatalogSource{fileCatalogSource{c.Snapshot}})
+	}
+	return sources
+}
+
+// fetchCatalog returns the cards from the first source that loads, and
+// that source.
+func fetchCatalog(sources []CatalogSource) ([]Card, CatalogSource, error) {
+	for _, source := range sources {
+		allCards, err := source.Load()
+		if err != nil {
+			log.Printf("catalog: %s: %v", source.Name(), err)
+			continue
+		}
+		log.Printf("catalog: loaded %d cards from %s", len(allCards), source.Name())
+		return allCards, source, nil
+	}
+	return nil, nil, errors.New("no catalog source could be loaded")
+}
+
+// saveSnapshot refreshes the snapshot among sources with the cards loaded
+// from, unless they came from the snapshot itself. It is only called once
+// the cards have passed validation, so a bad catalog never replaces a good
+// snapshot.
+func saveSnapshot(sources []CatalogSource, from CatalogSource, allCards []Card) {
+	if _, isSnapshot := from.(snapshotCatalogSource); isSnapshot {
+		return
+	}
+	for _, source := range sources {
+		if snapshot, ok := source.(snapshotCatalogSource); ok {
+			if err := snapshot.save(allCards); err != nil {
+				log.Printf("catalog: writing %s: %v", snapshot.Name(), err)
+			}
+		}
+	}
+}
+
+// Catalog is one loaded set of cards. It is never modified after
+// newCatalog returns, so readers may hold on to it for a whole request.
+type Catalog struct {
+	Cards    map[int]Card
+	ValidIds []int
+	// Pools are the regular roll pools, without any banner exclusives.
+	Pools       Pools
+	BannerPools map[string]Pools
+	LoadedAt    time.Time
+}
+
+// CatalogDiff lists the card ids that differ between two catalogs.
+type CatalogDiff struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+	Changed []int `json:"changed"`
+}
+
+func (d CatalogDiff) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+var catalog = struct {
+	sync.RWMutex
+	c *Catalog
+}{}
+
+// Serialises refreshes so two of them never diff against the same base.
+var catalogRefresh sync.Mutex
+
+func currentCatalog() *Catalog {
+	catalog.RLock()
+	defer catalog.RUnlock()
+	return catalog.c
+}
+
+func newCatalog(allCards []Card) (*Catalog, error) {
+	ret := &Catalog{Cards: make(map[int]Card), BannerPools: make(map[string]Pools), LoadedAt: time.Now()}
+	for _, card := range filterCards(allCards) {
+		if _, dup := ret.Cards[card.Id]; dup {
+			return nil, fmt.Errorf("duplicate card id %d", card.Id)
+		}
+		if card.Name == "" {
+			return nil, fmt.Errorf("card %d has no name", card.Id)
+		}
+		ret.Cards[card.Id] = card
+		ret.ValidIds = append(ret.ValidIds, card.Id)
+	}
+	sort.Ints(ret.ValidIds)
+
+	exclusive := exclusiveIds(config.Banners)
+	tierIds := make([][]int, len(config.Tiers))
+	for _, id := range ret.ValidIds {
+		if !exclusive[id] {
+			i := tierIndex(ret.Cards[id])
+			tierIds[i] = append(tierIds[i], id)
+		}
+	}
+	ret.Pools = make(Pools, len(config.Tiers))
+	for i, ids := range tierIds {
+		ret.Pools[i] = newPool(ids, nil)
+	}
+	if ret.Pools.total() == 0 {
+		return nil, errors.New("catalog has no rollable cards")
+	}
+
+	for _, banner := range config.Banners {
+		pools := make(Pools, len(config.Tiers))
+		ids := make([][]int, len(config.Tiers))
+		for i := range tierIds {
+			ids[i] = append([]int(nil), tierIds[i]...)
+		}
+		for _, id := range banner.Exclusive {
+			if card, ok := ret.Cards[id]; ok {
+				i := tierIndex(card)
+				ids[i] = append(ids[i], id)
+			} else {
+				log.Printf("catalog: banner %s: exclusive card %d is not in the catalog", banner.Name, id)
+			}
+		}
+		for i := range ids {
+			pools[i] = newPool(ids[i], banner.weight)
+		}
+		ret.BannerPools[banner.Name] = pools
+	}
+	return ret, nil
+}
+
+// poolsFor returns the pools of banner, or the regular pools if it is nil.
+func (c *Catalog) poolsFor(banner *Banner) Pools {
+	if banner == nil {
+		return c.Pools
+	}
+	return c.BannerPools[banner.Name]
+}
+
+func diffCatalogs(old, new *Catalog) (d CatalogDiff) {
+	for _, id := range new.ValidIds {
+		prev, ok := old.Cards[id]
+		if !ok {
+			d.Added = append(d.Added, id)
+		} else if prev != new.Cards[id] {
+			d.Changed = append(d.Changed, id)
+		}
+	}
+	for _, id := range old.ValidIds {
+		if _, ok := new.Cards[id]; !ok {
+			d.Removed = append(d.Removed, id)
+		}
+	}
+	return d
+}
+
+func loadCatalog() {
+	sources := catalogSources(config.Catalog)
+	allCards, from, err := fetchCatalog(sources)
+	if err != nil {
+		panic(err.Error())
+	}
+	c, err := newCatalog(allCards)
+	if err != nil {
+		panic(err.Error())
+	}
+	catalog.Lock()
+	catalog.c = c
+	catalog.Unlock()
+	saveSnapshot(sources, from, allCards)
+	checkShop(c)
+}
+
+// refreshCatalog fetches the catalog again and swaps it in if it passes
+// validation. A refresh that would remove more than MaxRemoved of the
+// current cards is refused, since that is far more likely to be a broken
+// upstream response than a real change.
+func refreshCatalog() (CatalogDiff, error) {
+	catalogRefresh.Lock()
+	defer catalogRefresh.Unlock()
+
+	sources := catalogSources(config.Catalog)
+	allCards, from, err := fetchCatalog(sources)
+	if err != nil {
+		return CatalogDiff{}, err
+	}
+	next, err := newCatalog(allCards)
+	if err != nil {
+		return CatalogDiff{}, err
+	}
+	old := currentCatalog()
+	diff := diffCatalogs(old, next)
+	if float64(len(diff.Removed)) > config.Catalog.MaxRemoved*float64(len(old.ValidIds)) {
+		return diff, fmt.Errorf("refusing refresh that removes %d of %d cards", len(diff.Removed), len(old.ValidIds))
+	}
+	catalog.Lock()
+	catalog.c = next
+	catalog.Unlock()
+	log.Printf("catalog: refreshed: %s", diff)
+	saveSnapshot(sources, from, allCards)
+	checkShop(next)
+	return diff, nil
+}
+
+func refreshCatalogEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := refreshCatalog(); err != nil {
+			log.Printf("catalog: refresh failed: %v", err)
+		}
+	}
+}
+
+func filterCards(cards []Card) (ret []Card) {
+	for _, card := range cards {
+		if !card.Jp_only {
+			ret = append(ret, card)
+		}
+	}
+	return ret
+}
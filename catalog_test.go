@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeCards(t *testing.T, path string, cards []Card) {
+	b, err := json.Marshal(cards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefusedRefreshKeepsSnapshot(t *testing.T) {
+	newTestChannel(t, newMemStore())
+	dir := t.TempDir()
+	config.Catalog.File = filepath.Join(dir, "catalog.json")
+	config.Catalog.Snapshot = filepath.Join(dir, "snapshot.json")
+	config.Catalog.Offline = true
+	config.Catalog.MaxRemoved = 0.1
+	good := []Card{
+		{Id: 1, Name: "Starter", Rarity: 1},
+		{Id: 2, Name: "Tamadra", Rarity: 2},
+		{Id: 3, Name: "Pengdra", Rarity: 3},
+	}
+	writeCards(t, config.Catalog.File, good)
+	loadCatalog()
+	snapshot, err := snapshotCatalogSource{fileCatalogSource{config.Catalog.Snapshot}}.Load()
+	if err != nil {
+		t.Fatalf("no snapshot after loading: %v", err)
+	}
+	if !reflect.DeepEqual(snapshot, good) {
+		t.Fatalf("snapshot has %v", snapshot)
+	}
+
+	writeCards(t, config.Catalog.File, good[:1])
+	if _, err := refreshCatalog(); err == nil {
+		t.Fatal("refresh removing two of three cards was not refused")
+	}
+	writeCards(t, config.Catalog.File, []Card{{Id: 1}})
+	if _, err := refreshCatalog(); err == nil {
+		t.Fatal("refresh with a nameless card was not refused")
+	}
+	snapshot, _ = snapshotCatalogSource{fileCatalogSource{config.Catalog.Snapshot}}.Load()
+	if !reflect.DeepEqual(snapshot, good) {
+		t.Errorf("refused refreshes changed the snapshot to %v", snapshot)
+	}
+	if _, err := os.Stat(config.Catalog.Snapshot + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("left %s.tmp behind", config.Catalog.Snapshot)
+	}
+}
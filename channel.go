@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"sync"
+)
+
+const channelParam string = "channel"
+
+// defaultChannelName is the channel used when none are configured. Rows
+// stored before there were channels belong to it.
+const defaultChannelName string = "default"
+
+var channelName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ChannelConfig is one streamer's channel. Sections it leaves out are
+// taken from the top level of the config.
+type ChannelConfig struct {
+	// Name selects the channel, as ?channel= or a /c/<name>/ path prefix.
+	Name string `json:"name"`
+	// Streamer is how the bot refers to the streamer in chat. It defaults
+	// to Name.
+	Streamer string `json:"streamer"`
+	// ChatChannel is the chat the chat client joins for this channel. It
+	// is left alone when empty.
+	ChatChannel string           `json:"chat_channel"`
+	Support     SupportConfig    `json:"support"`
+	Shouts      ShoutConfig      `json:"shouts"`
+	Moderation  ModerationConfig `json:"moderation"`
+}
+
+func validateChannel(c ChannelConfig) error {
+	if !channelName.MatchString(c.Name) {
+		return fmt.Errorf("channel name %q may only use letters, digits, - and _", c.Name)
+	}
+	if c.Support.Duration.Duration <= 0 {
+		return errors.New("support duration must be positive")
+	}
+	if c.Support.Slots < 1 {
+		return errors.New("support slots must be at least 1")
+	}
+	switch c.Shouts.Overflow {
+	case overflowReject, overflowDropOldest, overflowOnePerUser:
+	default:
+		return fmt.Errorf("unknown shout overflow policy %q", c.Shouts.Overflow)
+	}
+	if c.Shouts.Capacity < 1 {
+		return errors.New("shout capacity must be at least 1")
+	}
+	return nil
+}
+
+// Channel is everything one channel has to itself: its users, supporters
+// and shouts. Channels are created at startup and never change, so the
+// channels map needs no lock.
+type Channel struct {
+	ChannelConfig
+	store Store
+	users struct {
+		sync.RWMutex
+		m map[string]*User
+	}
+	// supporters holds who is on the overlay, up to Support.Slots, and who
+	// is waiting for a slot in the order they asked.
+	supporters struct {
+		sync.RWMutex
+		m       map[string]*Supporter
+		waiting []*User
+	}
+	shouts        *shoutBroker
+	moderation    *moderationQueue
+	bannedPattern *regexp.Regexp
+	cooldowns     *cooldownTracker
+}
+
+var channels = make(map[string]*Channel)
+
+// defaultChannel serves requests that do not name a channel. It is the
+// first one configured.
+var defaultChannel *Channel
+
+func newChannel(c ChannelConfig, store Store) *Channel {
+	ch := &Channel{ChannelConfig: c, store: store}
+	ch.users.m = make(map[string]*User)
+	ch.supporters.m = make(map[string]*Supporter)
+	ch.shouts = newShoutBroker(ch, 100)
+	ch.moderation = &moderationQueue{ch: ch, nextId: 1}
+	ch.bannedPattern = compileBannedWords(c.Moderation.BannedWords)
+	ch.cooldowns = newCooldownTracker()
+	return ch
+}
+
+// openChannels sets up every configured channel and loads its users.
+func openChannels() {
+	storeFor := openStore(config.Storage)
+	for _, c := range config.Channels {
+		ch := newChannel(c, storeFor(c.Name))
+		loaded, err := ch.store.LoadUsers()
+		if err != nil {
+			panic(err)
+		}
+		for _, user := range loaded {
+			user.Box.Size = config.BoxSize
+			ch.users.m[user.Name] = user
+		}
+		channels[c.Name] = ch
+		if defaultChannel == nil {
+			defaultChannel = ch
+		}
+	}
+}
+
+// withChannel finds the channel a request is for, from the path prefix or
+// the channel param, falling back to the default channel.
+func withChannel(ctx *gin.Context) {
+	name := ctx.Param(channelParam)
+	if name == "" {
+		name = ctx.Query(channelParam)
+	}
+	ch := defaultChannel
+	if name != "" {
+		var ok bool
+		ch, ok = channels[name]
+		if !ok {
+			ctx.String(404, "There is no channel called "+name+".")
+			ctx.Abort()
+			return
+		}
+	}
+	ctx.Set(channelParam, ch)
+}
+
+func channelOf(ctx *gin.Context) *Channel {
+	return ctx.MustGet(channelParam).(*Channel)
+}
+
+// base is the path prefix of ch, for pages that call back to the server.
+func (ch *Channel) base() string {
+	return "/c/" + ch.Name + "/"
+}
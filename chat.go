@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatConfig connects flafu to chat itself, speaking Twitch's dialect of
+// IRC, instead of relying on a bot calling the HTTP commands.
+type ChatConfig struct {
+	// Address is the IRC server, like "irc.chat.twitch.tv:6697". Chat is
+	// off while it is empty.
+	Address string `json:"address"`
+	TLS     bool   `json:"tls"`
+	Nick    string `json:"nick"`
+	// Password is the bot account's "oauth:..." token.
+	Password string `json:"password"`
+	// Prefix starts a command in chat.
+	Prefix string `json:"prefix"`
+	// At most MessageLimit messages are sent every MessagePeriod. Twitch
+	// allows 20 every 30 seconds.
+	MessageLimit  int      `json:"message_limit"`
+	MessagePeriod Duration `json:"message_period"`
+	// ReconnectDelay is the longest wait between attempts to reconnect.
+	ReconnectDelay Duration `json:"reconnect_delay"`
+}
+
+func validateChat(c ChatConfig) error {
+	if c.Address == "" {
+		return nil
+	}
+	if c.Nick == "" {
+		return errors.New("chat needs a nick")
+	}
+	if c.Prefix == "" {
+		return errors.New("chat needs a command prefix")
+	}
+	if c.MessageLimit < 1 || c.MessagePeriod.Duration <= 0 {
+		return errors.New("chat message limit and period must be positive")
+	}
+	if c.ReconnectDelay.Duration < time.Second {
+		return errors.New("chat reconnect delay must be at least 1s")
+	}
+	return nil
+}
+
+// chatLineLimit is the longest message Twitch accepts.
+const chatLineLimit int = 500
+
+// ircMessage is one line of IRC with its IRCv3 tags.
+type ircMessage struct {
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+var tagEscapes = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+func parseIRC(line string) (ircMessage, error) {
+	var m ircMessage
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return m, errors.New("only tags")
+		}
+		m.Tags = make(map[string]string)
+		for _, tag := range strings.Split(line[1:i], ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) == 2 {
+				m.Tags[kv[0]] = tagEscapes.Replace(kv[1])
+			} else {
+				m.Tags[kv[0]] = ""
+			}
+		}
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return m, errors.New("only a prefix")
+		}
+		m.Prefix = line[1:i]
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+	for line != "" {
+		if line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			m.Params = append(m.Params, line)
+			break
+		}
+		m.Params = append(m.Params, line[:i])
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+	if len(m.Params) == 0 {
+		return m, errors.New("no command")
+	}
+	m.Command, m.Params = strings.ToUpper(m.Params[0]), m.Params[1:]
+	return m, nil
+}
+
+// nick is who sent m.
+func (m ircMessage) nick() string {
+	if i := strings.IndexByte(m.Prefix, '!'); i >= 0 {
+		return m.Prefix[:i]
+	}
+	return m.Prefix
+}
+
+func (m ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// ChatUser is who sent a chat message, from its Twitch tags. Commands go
+// by Name, the login name, like the user= a bot passes over HTTP; Id and
+// DisplayName are only logged.
+type ChatUser struct {
+	Id          string
+	Name        string
+	DisplayName string
+	// Badges maps badge names, like "moderator", to their versions.
+	Badges map[string]string
+}
+
+func chatUser(m ircMessage) ChatUser {
+	u := ChatUser{
+		Id:          m.Tags["user-id"],
+		Name:        strings.ToLower(m.nick()),
+		DisplayName: m.Tags["display-name"],
+		Badges:      make(map[string]string),
+	}
+	if u.DisplayName == "" {
+		u.DisplayName = m.nick()
+	}
+	for _, badge := range strings.Split(m.Tags["badges"], ",") {
+		if badge == "" {
+			continue
+		}
+		kv := strings.SplitN(badge, "/", 2)
+		if len(kv) == 2 {
+			u.Badges[kv[0]] = kv[1]
+		} else {
+			u.Badges[kv[0]] = ""
+		}
+	}
+	return u
+}
+
+// moderates reports whether u is the broadcaster or one of their
+// moderators.
+func (u ChatUser) moderates() bool {
+	_, broadcaster := u.Badges["broadcaster"]
+	_, moderator := u.Badges["moderator"]
+	return broadcaster || moderator
+}
+
+// modCommands can only be used in chat, and only by moderators. Their
+// args name the user they act on instead of who sent them.
+var modCommands = map[string]Command{
+	"grant": grant,
+}
+
+// chatArgs turns the words after a chat command into the args its Command
+// takes over HTTP.
+func chatArgs(name string, words []string) url.Values {
+	args := url.Values{}
+	switch name {
+	case "roll":
+		for _, w := range words {
+			if _, err := strconv.Atoi(w); err == nil {
+				args.Set(countParam, w)
+			} else {
+				args.Set(bannerParam, w)
+			}
+		}
+	case "roll10", "rates":
+		if len(words) > 0 {
+			args.Set(bannerParam, words[0])
+		}
+	case "keep", "leader", "release":
+		if len(words) > 0 {
+			args.Set(cardParam, words[0])
+		}
+	case "shout":
+		args.Set(messageParam, strings.Join(words, " "))
+	case "sell":
+		// "!sell 3" sells from the box, "!sell new 2" a new card.
+		if len(words) > 0 && words[0] == pendingParam {
+			args.Set(pendingParam, "0")
+			if len(words) > 1 {
+				args.Set(pendingParam, words[1])
+			}
+		} else if len(words) > 0 {
+			args.Set(cardParam, words[0])
+		}
+	case "buy":
+		if len(words) > 0 {
+			args.Set(itemParam, words[0])
+		}
+	case "grant":
+		// "!grant @mia 50"
+		if len(words) > 0 {
+			args.Set(userParam, strings.ToLower(strings.TrimPrefix(words[0], "@")))
+		}
+		if len(words) > 1 {
+			args.Set(stonesParam, words[1])
+		}
+	}
+	return args
+}
+
+// chatClient runs the commands it reads in its rooms and replies there.
+type chatClient struct {
+	cfg ChatConfig
+	// dial opens the connection to the server. It can be replaced to talk
+	// to something other than cfg.Address.
+	dial func() (net.Conn, error)
+	// rooms maps IRC channels, with their '#', to flafu channels.
+	rooms map[string]*Channel
+	say   chan string
+
+	sync.Mutex
+	conn net.Conn
+}
+
+func newChatClient(cfg ChatConfig, rooms map[string]*Channel) *chatClient {
+	c := &chatClient{cfg: cfg, rooms: rooms, say: make(chan string, 100)}
+	c.dial = func() (net.Conn, error) {
+		d := &net.Dialer{Timeout: 10 * time.Second}
+		if cfg.TLS {
+			return tls.DialWithDialer(d, "tcp", cfg.Address, nil)
+		}
+		return d.Dial("tcp", cfg.Address)
+	}
+	return c
+}
+
+// chatRooms maps the chat channel of every channel that has one.
+func chatRooms() map[string]*Channel {
+	rooms := make(map[string]*Channel)
+	for _, ch := range channels {
+		if ch.ChatChannel != "" {
+			rooms["#"+strings.ToLower(ch.ChatChannel)] = ch
+		}
+	}
+	return rooms
+}
+
+// run keeps the client connected. It waits a second before reconnecting,
+// doubling that after every quick failure up to ReconnectDelay.
+func (c *chatClient) run() {
+	go c.speak()
+	delay := time.Second
+	for {
+		started := time.Now()
+		err := c.session()
+		log.Printf("chat: disconnected: %v", err)
+		if time.Since(started) > c.cfg.ReconnectDelay.Duration {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > c.cfg.ReconnectDelay.Duration {
+			delay = c.cfg.ReconnectDelay.Duration
+		}
+	}
+}
+
+func (c *chatClient) session() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.Lock()
+	c.conn = conn
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.conn = nil
+		c.Unlock()
+	}()
+
+	if c.cfg.Password != "" {
+		c.write("PASS " + c.cfg.Password)
+	}
+	c.write("NICK " + c.cfg.Nick)
+	c.write("CAP REQ :twitch.tv/tags twitch.tv/commands")
+	for room := range c.rooms {
+		c.write("JOIN " + room)
+	}
+	log.Printf("chat: connected to %s as %s", c.cfg.Address, c.cfg.Nick)
+
+	r := bufio.NewReader(conn)
+	for {
+		// Twitch pings about every five minutes.
+		conn.SetReadDeadline(time.Now().Add(6 * time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		m, err := parseIRC(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			log.Printf("chat: unreadable line %q: %v", line, err)
+			continue
+		}
+		switch m.Command {
+		case "PING":
+			c.write("PONG :" + m.param(0))
+		case "RECONNECT":
+			return errors.New("server asked us to reconnect")
+		case "NOTICE":
+			log.Printf("chat: notice: %s", m.param(1))
+		case "PRIVMSG":
+			go c.handle(m)
+		}
+	}
+}
+
+// write sends line now, bypassing the rate limit. Only protocol lines
+// should use it; chat goes through say.
+func (c *chatClient) write(line string) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		return errors.New("not connected")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// speak sends chat messages, never more than MessageLimit in any
+// MessagePeriod.
+func (c *chatClient) speak() {
+	var sent []time.Time
+	for line := range c.say {
+		if len(sent) == c.cfg.MessageLimit {
+			time.Sleep(time.Until(sent[0].Add(c.cfg.MessagePeriod.Duration)))
+			sent = sent[1:]
+		}
+		if err := c.write(line); err != nil {
+			log.Printf("chat: lost message %q: %v", line, err)
+		}
+		sent = append(sent, time.Now())
+	}
+}
+
+func (c *chatClient) reply(room string, text string) {
+	text = strings.Replace(text, "\n", " ", -1)
+	if len(text) > chatLineLimit {
+		cut := strings.LastIndex(text[:chatLineLimit-3], " ")
+		if cut < 0 {
+			cut = chatLineLimit - 3
+		}
+		text = text[:cut] + "..."
+	}
+	select {
+	case c.say <- "PRIVMSG " + room + " :" + text:
+	default:
+		log.Printf("chat: too much to say, dropped %q", text)
+	}
+}
+
+func (c *chatClient) handle(m ircMessage) {
+	room := m.param(0)
+	ch, ok := c.rooms[room]
+	if !ok {
+		return
+	}
+	text := m.param(1)
+	if !strings.HasPrefix(text, c.cfg.Prefix) {
+		return
+	}
+	words := strings.Fields(text[len(c.cfg.Prefix):])
+	if len(words) == 0 {
+		return
+	}
+	name := strings.ToLower(words[0])
+	modCommand, isModCommand := modCommands[name]
+	if _, ok := commands[name]; !ok && !isModCommand {
+		return
+	}
+	if strings.EqualFold(m.nick(), c.cfg.Nick) {
+		return
+	}
+	user := chatUser(m)
+	if isModCommand && !user.moderates() {
+		return
+	}
+	log.Printf("chat: %s %s (%s, %s): %s", room, user.Name, user.DisplayName, user.Id, text)
+	args := chatArgs(name, words[1:])
+	if isModCommand {
+		c.reply(room, modCommand(ch, args))
+		return
+	}
+	args.Set(userParam, user.Name)
+	c.reply(room, runCommand(ch, name, args))
+}
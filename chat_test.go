@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIRC(t *testing.T) {
+	tests := []struct {
+		line string
+		want ircMessage
+	}{
+		{"PING :tmi.twitch.tv", ircMessage{Command: "PING", Params: []string{"tmi.twitch.tv"}}},
+		{":tmi.twitch.tv 001 flafubot :Welcome, GLHF!", ircMessage{
+			Prefix:  "tmi.twitch.tv",
+			Command: "001",
+			Params:  []string{"flafubot", "Welcome, GLHF!"},
+		}},
+		{"@badges=;display-name=Mia;user-id=42 :mia!mia@mia.tmi.twitch.tv PRIVMSG #sweetily :!roll 10", ircMessage{
+			Tags:    map[string]string{"badges": "", "display-name": "Mia", "user-id": "42"},
+			Prefix:  "mia!mia@mia.tmi.twitch.tv",
+			Command: "PRIVMSG",
+			Params:  []string{"#sweetily", "!roll 10"},
+		}},
+		{`@msg=a\sb\:c\\d\re\nf;flag :x privmsg  #a  :b`, ircMessage{
+			Tags:    map[string]string{"msg": "a b;c\\d\re\nf", "flag": ""},
+			Prefix:  "x",
+			Command: "PRIVMSG",
+			Params:  []string{"#a", "b"},
+		}},
+		{"JOIN #a", ircMessage{Command: "JOIN", Params: []string{"#a"}}},
+	}
+	for _, test := range tests {
+		got, err := parseIRC(test.line)
+		if err != nil {
+			t.Errorf("parseIRC(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseIRC(%q) = %#v, want %#v", test.line, got, test.want)
+		}
+	}
+	for _, line := range []string{"", "@a=b", ":prefix", ":prefix "} {
+		if _, err := parseIRC(line); err == nil {
+			t.Errorf("parseIRC(%q) did not fail", line)
+		}
+	}
+}
+
+func TestChatUser(t *testing.T) {
+	m, _ := parseIRC("@badges=moderator/1,subscriber/12;display-name=Mia;user-id=42 :mia!mia@mia.tmi.twitch.tv PRIVMSG #a :hi")
+	u := chatUser(m)
+	want := ChatUser{Id: "42", Name: "mia", DisplayName: "Mia", Badges: map[string]string{"moderator": "1", "subscriber": "12"}}
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("chatUser = %+v, want %+v", u, want)
+	}
+	if !u.moderates() {
+		t.Error("a moderator does not moderate")
+	}
+
+	m, _ = parseIRC("@badges=;user-id=42 :mia!mia@mia.tmi.twitch.tv PRIVMSG #a :hi")
+	if u := chatUser(m); u.Name != "mia" || u.DisplayName != "mia" || u.moderates() {
+		t.Errorf("chatUser without display-name or badges = %+v", u)
+	}
+	m, _ = parseIRC("@badges=broadcaster/1 :tester!tester@tester.tmi.twitch.tv PRIVMSG #a :hi")
+	if !chatUser(m).moderates() {
+		t.Error("the broadcaster does not moderate")
+	}
+}
+
+// fakeIRC is the server end of one chat client connection.
+type fakeIRC struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func acceptIRC(t *testing.T, ln net.Listener) *fakeIRC {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeIRC{t, conn, bufio.NewReader(conn)}
+}
+
+func (f *fakeIRC) read() string {
+	f.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := f.r.ReadString('\n')
+	if err != nil {
+		f.t.Fatalf("reading from the client: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func (f *fakeIRC) expect(want string) {
+	if got := f.read(); got != want {
+		f.t.Fatalf("client sent %q, want %q", got, want)
+	}
+}
+
+func (f *fakeIRC) send(line string) {
+	if _, err := f.conn.Write([]byte(line + "\r\n")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeIRC) handshake() {
+	f.expect("PASS oauth:secret")
+	f.expect("NICK flafubot")
+	f.expect("CAP REQ :twitch.tv/tags twitch.tv/commands")
+	f.expect("JOIN #test")
+}
+
+// startChat runs a chat client for a memStore-backed channel against a
+// fake server.
+func startChat(t *testing.T, limit int, period time.Duration) (net.Listener, *Channel) {
+	ch := newTestChannel(t, newMemStore())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cfg := ChatConfig{
+		Nick:           "flafubot",
+		Password:       "oauth:secret",
+		Prefix:         "!",
+		MessageLimit:   limit,
+		MessagePeriod:  Duration{period},
+		ReconnectDelay: Duration{time.Second},
+	}
+	c := newChatClient(cfg, map[string]*Channel{"#test": ch})
+	c.dial = func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	go c.run()
+	return ln, ch
+}
+
+// privmsg is text sent by mia, whose display name differs in case.
+func privmsg(text string) string {
+	return "@badges=subscriber/12;display-name=Mia;user-id=42 :mia!mia@mia.tmi.twitch.tv PRIVMSG #test :" + text
+}
+
+func TestChatSession(t *testing.T) {
+	ln, ch := startChat(t, 20, 30*time.Second)
+	server := acceptIRC(t, ln)
+	server.handshake()
+
+	server.send("PING :tmi.twitch.tv")
+	server.expect("PONG :tmi.twitch.tv")
+
+	server.send(privmsg("!scam"))
+	server.expect("PRIVMSG #test :mia has been successfully scammed.")
+	server.send(privmsg("!roll"))
+	if got := server.read(); !strings.HasPrefix(got, "PRIVMSG #test :mia's roll: ") {
+		t.Fatalf("roll reply %q", got)
+	}
+	// The box is the one the HTTP bot's user=mia uses.
+	if pending := boxOf(t, ch, "mia").Box.Pending; len(pending) != 1 {
+		t.Fatalf("mia has %d new cards after rolling", len(pending))
+	}
+	// Its own messages, unknown commands and moderator commands from
+	// anyone else get no reply.
+	server.send(":flafubot!flafubot@flafubot.tmi.twitch.tv PRIVMSG #test :!status")
+	server.send(privmsg("!nope"))
+	server.send(privmsg("!grant mia 7"))
+	server.send(privmsg("!status"))
+	if got := server.read(); !strings.HasPrefix(got, "PRIVMSG #test :mia's box") {
+		t.Fatalf("status reply %q", got)
+	}
+	server.send("@badges=broadcaster/1 :tester!tester@tester.tmi.twitch.tv PRIVMSG #test :!grant @Mia 50")
+	server.expect("PRIVMSG #test :mia got 50 stones and now has 50.")
+	server.send("@badges=moderator/1 :leo!leo@leo.tmi.twitch.tv PRIVMSG #test :!grant nobody 5")
+	server.expect("PRIVMSG #test :nobody has not been scammed yet.")
+
+	server.send(":tmi.twitch.tv RECONNECT")
+	server = acceptIRC(t, ln)
+	server.handshake()
+	server.send("PING :again")
+	server.expect("PONG :again")
+}
+
+func TestChatRateLimit(t *testing.T) {
+	period := 500 * time.Millisecond
+	ln, _ := startChat(t, 2, period)
+	server := acceptIRC(t, ln)
+	server.handshake()
+
+	var arrived []time.Time
+	for i := 0; i < 3; i++ {
+		server.send(privmsg("!banners"))
+	}
+	for i := 0; i < 3; i++ {
+		server.expect("PRIVMSG #test :No banners are running right now.")
+		arrived = append(arrived, time.Now())
+	}
+	if gap := arrived[1].Sub(arrived[0]); gap > period/2 {
+		t.Errorf("second message waited %v", gap)
+	}
+	if gap := arrived[2].Sub(arrived[0]); gap < period*9/10 {
+		t.Errorf("third message came %v after the first, want at least %v", gap, period)
+	}
+}
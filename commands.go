@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/url"
+	"time"
+)
+
+// Command runs one external command for a channel and returns the reply.
+// args holds its parameters by name: the query string over HTTP, or what
+// the chat client read from the message.
+type Command func(ch *Channel, args url.Values) string
+
+// commands are the external commands, served as /<name> over HTTP and as
+// !<name> in chat.
+var commands = map[string]Command{
+	"roll":      roll,
+	"roll10":    roll10,
+	"scam":      scam,
+	"status":    status,
+	"keep":      keep,
+	"leader":    leader,
+	"release":   release,
+	"support":   support,
+	"unsupport": unsupport,
+	"shout":     shout,
+	"rates":     showRates,
+	"banners":   showBanners,
+	"sell":      sell,
+	"shop":      showShop,
+	"buy":       buy,
+	"history":   history,
+}
+
+// runCommand runs the command called name for the user in args, unless it
+// is cooling down. Running it counts as the user being active, and any
+// daily stones they got are added to the reply.
+func runCommand(ch *Channel, name string, args url.Values) string {
+	user := args.Get(userParam)
+	now := time.Now()
+	if wait := ch.cooldowns.take(name, user, now); wait > 0 {
+		return tryAgain(user, name, wait)
+	}
+	bonus := ch.visit(user, now)
+	reply := commands[name](ch, args)
+	if bonus != "" {
+		reply = reply + " " + bonus
+	}
+	return reply
+}
+
+func httpCommand(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.String(200, runCommand(channelOf(ctx), name, ctx.Request.URL.Query()))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const defaultConfigPath string = "config.json"
+
+// Duration is a time.Duration that reads from JSON strings like "90s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Config struct {
+	// AdminToken must be passed as ?token= to the /admin routes. The
+	// routes are disabled while it is empty.
+	AdminToken string `json:"admin_token"`
+	// Bots may call the external commands. While there are none, every
+	// external command is refused.
+	Bots    []BotConfig   `json:"bots"`
+	Catalog CatalogConfig `json:"catalog"`
+	// Tiers are the egg tiers from best to worst. See Tier.
+	Tiers   []Tier     `json:"tiers"`
+	Banners []Banner   `json:"banners"`
+	Pity    PityConfig `json:"pity"`
+	// MaxRolls caps /roll?count=. /roll10 is refused below 10.
+	MaxRolls int `json:"max_rolls"`
+	// BoxSize is how many cards a user can own, leader included.
+	BoxSize int `json:"box_size"`
+	// Shop lists the cards that can be bought with monster points.
+	Shop []ShopItem `json:"shop"`
+	// Stones are what rolls cost and how users earn them.
+	Stones StoneConfig `json:"stones"`
+	// Cooldowns limit how often each external command runs, by command
+	// name. Commands not listed have no limit.
+	Cooldowns map[string]CooldownConfig `json:"cooldowns"`
+	// MigrateOnStart applies pending migrations at startup. When off the
+	// server refuses to start until "flafu migrate" has been run.
+	MigrateOnStart bool `json:"migrate_on_start"`
+	// Storage is "postgres" ($DATABASE_URL) or "memory", which keeps
+	// nothing across restarts.
+	Storage string `json:"storage"`
+	// Streamer and ChatChannel are for the default channel, used when no
+	// channels are configured.
+	Streamer    string     `json:"streamer"`
+	ChatChannel string     `json:"chat_channel"`
+	Chat        ChatConfig `json:"chat"`
+	// Support, Shouts and Moderation are the settings of channels that do
+	// not have their own.
+	Support    SupportConfig    `json:"support"`
+	Shouts     ShoutConfig      `json:"shouts"`
+	Moderation ModerationConfig `json:"moderation"`
+	// Channels are decoded by readConfig over the settings above.
+	Channels []ChannelConfig `json:"-"`
+}
+
+type SupportConfig struct {
+	// Duration is how long a supporter stays on the overlay.
+	Duration Duration `json:"duration"`
+	// Slots is how many users can support at once. Anyone else waits in
+	// line for a slot.
+	Slots int `json:"slots"`
+}
+
+type ShoutConfig struct {
+	// AckTimeout is the longest a shout stays on air waiting for overlays
+	// to say they have finished playing it.
+	AckTimeout Duration `json:"ack_timeout"`
+	// Capacity is how many shouts may wait at once. Overflow is what
+	// happens past that: "reject", "drop_oldest" or "one_per_user".
+	Capacity int    `json:"capacity"`
+	Overflow string `json:"overflow"`
+}
+
+type CatalogConfig struct {
+	// URL is the remote monster API. Skipped when Offline is set.
+	URL string `json:"url"`
+	// File is an optional local catalog tried before the remote one.
+	File string `json:"file"`
+	// Snapshot is where the last good catalog is written, and the
+	// fallback when every other source fails.
+	Snapshot string   `json:"snapshot"`
+	Offline  bool     `json:"offline"`
+	Timeout  Duration `json:"timeout"`
+	// RefreshInterval reloads the catalog in the background. Zero
+	// disables it; /admin/refresh still works.
+	RefreshInterval Duration `json:"refresh_interval"`
+	// MaxRemoved is the largest fraction of cards a refresh may remove.
+	MaxRemoved float64 `json:"max_removed"`
+}
+
+var config Config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Pity:           PityConfig{Threshold: 100, Tier: "gold"},
+		MaxRolls:       10,
+		BoxSize:        20,
+		MigrateOnStart: true,
+		Storage:        "postgres",
+		Streamer:       "Sweetily",
+		Support:        SupportConfig{Duration: Duration{time.Minute}, Slots: 1},
+		Chat: ChatConfig{
+			Prefix:         "!",
+			MessageLimit:   20,
+			MessagePeriod:  Duration{30 * time.Second},
+			ReconnectDelay: Duration{2 * time.Minute},
+		},
+		Shouts: ShoutConfig{
+			AckTimeout: Duration{30 * time.Second},
+			Capacity:   100,
+			Overflow:   "reject",
+		},
+		Stones: StoneConfig{
+			RollCost:     5,
+			ActiveGrant:  1,
+			ActiveWindow: Duration{10 * time.Minute},
+			DailyGrant:   10,
+		},
+		Catalog: CatalogConfig{
+			URL:        "https://www.padherder.com/api/monsters/",
+			Snapshot:   "catalog_snapshot.json",
+			Timeout:    Duration{10 * time.Second},
+			MaxRemoved: 0.1,
+		},
+	}
+}
+
+// loadConfig reads and validates the configuration. Lists and maps that the
+// file leaves out are filled with their defaults afterwards rather than
+// before, since decoding over a default would merge the two.
+func loadConfig() Config {
+	ret := readConfig()
+	if len(ret.Tiers) == 0 {
+		ret.Tiers = defaultTiers()
+	}
+	if err := validateTiers(ret.Tiers); err != nil {
+		panic(err)
+	}
+	for i := range ret.Banners {
+		if ret.Banners[i].Title == "" {
+			ret.Banners[i].Title = ret.Banners[i].Name
+		}
+	}
+	if err := validateBanners(ret.Banners); err != nil {
+		panic(err)
+	}
+	if err := validatePity(ret.Pity, ret.Tiers); err != nil {
+		panic(err)
+	}
+	if err := validateShop(ret.Shop); err != nil {
+		panic(err)
+	}
+	if err := validateStones(ret.Stones); err != nil {
+		panic(err)
+	}
+	if ret.Cooldowns == nil {
+		ret.Cooldowns = defaultCooldowns()
+	}
+	if err := validateCooldowns(ret.Cooldowns); err != nil {
+		panic(err)
+	}
+	if len(ret.Channels) == 0 {
+		ret.Channels = []ChannelConfig{{
+			Name:        defaultChannelName,
+			Streamer:    ret.Streamer,
+			ChatChannel: ret.ChatChannel,
+			Support:     ret.Support,
+			Shouts:      ret.Shouts,
+			Moderation:  ret.Moderation,
+		}}
+	}
+	seen := make(map[string]bool)
+	for i, c := range ret.Channels {
+		if err := validateChannel(c); err != nil {
+			panic(fmt.Sprintf("channel %q: %v", c.Name, err))
+		}
+		if seen[c.Name] {
+			panic(fmt.Sprintf("duplicate channel %q", c.Name))
+		}
+		seen[c.Name] = true
+		if c.Streamer == "" {
+			ret.Channels[i].Streamer = c.Name
+		}
+	}
+	if err := validateBots(ret.Bots, ret.Channels); err != nil {
+		panic(err)
+	}
+	if err := validateChat(ret.Chat); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// readConfig reads the JSON file named by $FLAFU_CONFIG (config.json by
+// default) over the defaults. A missing default file is not an error.
+func readConfig() Config {
+	ret := defaultConfig()
+	path := os.Getenv("FLAFU_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !explicit {
+		return ret
+	}
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(b, &ret)
+	if err != nil {
+		panic(err)
+	}
+	ret.Channels, err = decodeChannels(b, ret)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// decodeChannels decodes each channel over the top level settings, so a
+// channel only lists what it changes.
+func decodeChannels(b []byte, top Config) ([]ChannelConfig, error) {
+	var raw struct {
+		Channels []json.RawMessage `json:"channels"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	var ret []ChannelConfig
+	for _, r := range raw.Channels {
+		c := ChannelConfig{
+			Support:    top.Support,
+			Shouts:     top.Shouts,
+			Moderation: top.Moderation,
+		}
+		// Unmarshal reuses a slice's array, so each channel needs its own.
+		c.Moderation.BannedWords = append([]string(nil), top.Moderation.BannedWords...)
+		if err := json.Unmarshal(r, &c); err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
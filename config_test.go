@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeChannelsKeepsTopLevelBannedWords(t *testing.T) {
+	b := []byte(`{
+		"moderation": {"banned_words": ["a", "b"]},
+		"channels": [
+			{"name": "one", "moderation": {"banned_words": ["c"]}},
+			{"name": "two"}
+		]
+	}`)
+	top := defaultConfig()
+	top.Moderation.BannedWords = []string{"a", "b"}
+	channels, err := decodeChannels(b, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := channels[0].Moderation.BannedWords; !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("channel one bans %v", got)
+	}
+	if got := channels[1].Moderation.BannedWords; !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("channel two bans %v", got)
+	}
+	if !reflect.DeepEqual(top.Moderation.BannedWords, []string{"a", "b"}) {
+		t.Errorf("top level bans %v", top.Moderation.BannedWords)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// CooldownConfig limits how often one command runs on a channel.
+type CooldownConfig struct {
+	// User is how long a user waits between two uses of the command.
+	User Duration `json:"user"`
+	// At most Limit uses by anyone go through in any Period. Zero Limit
+	// means no cap.
+	Limit  int      `json:"limit"`
+	Period Duration `json:"period"`
+}
+
+func defaultCooldowns() map[string]CooldownConfig {
+	return map[string]CooldownConfig{
+		"roll":    {User: Duration{5 * time.Second}, Limit: 30, Period: Duration{10 * time.Second}},
+		"roll10":  {User: Duration{30 * time.Second}, Limit: 10, Period: Duration{10 * time.Second}},
+		"shout":   {User: Duration{time.Minute}, Limit: 10, Period: Duration{time.Minute}},
+		"support": {User: Duration{10 * time.Second}},
+	}
+}
+
+func validateCooldowns(cooldowns map[string]CooldownConfig) error {
+	for name, c := range cooldowns {
+		if _, ok := commands[name]; !ok {
+			return fmt.Errorf("cooldown for unknown command %q", name)
+		}
+		if c.User.Duration < 0 || c.Limit < 0 {
+			return fmt.Errorf("cooldown for %s cannot be negative", name)
+		}
+		if c.Limit > 0 && c.Period.Duration <= 0 {
+			return fmt.Errorf("cooldown for %s needs a positive period", name)
+		}
+	}
+	return nil
+}
+
+// cooldownTracker remembers recent commands on one channel.
+type cooldownTracker struct {
+	sync.Mutex
+	// until maps a command and user to when they may use it again.
+	until map[string]time.Time
+	// recent holds when each command went through, oldest first, within
+	// its period.
+	recent map[string][]time.Time
+	// pruneAt is how big until may grow before expired entries are
+	// cleared out.
+	pruneAt int
+}
+
+func newCooldownTracker() *cooldownTracker {
+	return &cooldownTracker{until: make(map[string]time.Time), recent: make(map[string][]time.Time), pruneAt: 1000}
+}
+
+// take records user running name at now and returns zero, or returns how
+// long they have to wait without recording anything.
+func (t *cooldownTracker) take(name string, user string, now time.Time) time.Duration {
+	c, ok := config.Cooldowns[name]
+	if !ok {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	key := name + "\x00" + user
+	if wait := t.until[key].Sub(now); wait > 0 {
+		return wait
+	}
+	if c.Limit > 0 {
+		recent := t.recent[name]
+		for len(recent) > 0 && !now.Before(recent[0].Add(c.Period.Duration)) {
+			recent = recent[1:]
+		}
+		t.recent[name] = recent
+		if len(recent) >= c.Limit {
+			return recent[0].Add(c.Period.Duration).Sub(now)
+		}
+		t.recent[name] = append(recent, now)
+	}
+	if c.User.Duration > 0 {
+		t.until[key] = now.Add(c.User.Duration)
+		t.prune(now)
+	}
+	return 0
+}
+
+func (t *cooldownTracker) prune(now time.Time) {
+	if len(t.until) < t.pruneAt {
+		return
+	}
+	for key, until := range t.until {
+		if !now.Before(until) {
+			delete(t.until, key)
+		}
+	}
+	t.pruneAt = 2 * len(t.until)
+	if t.pruneAt < 1000 {
+		t.pruneAt = 1000
+	}
+}
+
+// tryAgain tells user how long to wait, in whole seconds rounded up.
+func tryAgain(user string, name string, wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if user == "" {
+		return fmt.Sprintf("%s is cooling down, try again in %ds.", name, seconds)
+	}
+	return fmt.Sprintf("%s, %s is cooling down, try again in %ds.", user, name, seconds)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Tier is one egg tier. Config lists tiers from best to worst; a card
+// belongs to the first tier whose thresholds it meets, and anything that
+// meets none falls into the last one. A zero threshold is ignored.
+type Tier struct {
+	Name             string  `json:"name"`
+	Label            string  `json:"label"`
+	MinMonsterPoints int     `json:"min_monster_points"`
+	MinRarity        int     `json:"min_rarity"`
+	Weight           float64 `json:"weight"`
+}
+
+func (t Tier) matches(card Card) bool {
+	if t.MinMonsterPoints == 0 && t.MinRarity == 0 {
+		return true
+	}
+	return (t.MinMonsterPoints > 0 && card.Monster_points >= t.MinMonsterPoints) ||
+		(t.MinRarity > 0 && card.Rarity >= t.MinRarity)
+}
+
+// Rate is the published chance of rolling from a tier.
+type Rate struct {
+	Tier    string  `json:"tier"`
+	Label   string  `json:"label"`
+	Percent float64 `json:"percent"`
+	Cards   int     `json:"cards"`
+}
+
+func defaultTiers() []Tier {
+	return []Tier{
+		{Name: "diamond", Label: "DIAMOND EGG!!!", MinMonsterPoints: 15000, MinRarity: 9, Weight: 2},
+		{Name: "gold", Label: "GOLD EGG!!", MinMonsterPoints: 5000, MinRarity: 7, Weight: 8},
+		{Name: "silver", Label: "SILVER EGG!", MinMonsterPoints: 3000, MinRarity: 5, Weight: 25},
+		{Name: "bronze", Label: "BRONZE EGG", Weight: 65},
+	}
+}
+
+func validateTiers(tiers []Tier) error {
+	if len(tiers) == 0 {
+		return errors.New("no tiers configured")
+	}
+	total := 0.0
+	seen := make(map[string]bool)
+	for i, tier := range tiers {
+		if tier.Name == "" {
+			return errors.New("tier without a name")
+		}
+		if seen[tier.Name] {
+			return fmt.Errorf("duplicate tier %q", tier.Name)
+		}
+		seen[tier.Name] = true
+		if tier.Weight < 0 {
+			return fmt.Errorf("tier %q has a negative weight", tier.Name)
+		}
+		// A tier without thresholds takes every card, leaving none for the
+		// tiers after it.
+		if tier.MinMonsterPoints == 0 && tier.MinRarity == 0 && i < len(tiers)-1 {
+			return fmt.Errorf("tier %q has no thresholds; only the last tier may take every card", tier.Name)
+		}
+		total += tier.Weight
+	}
+	if total <= 0 {
+		return errors.New("tier weights add up to zero")
+	}
+	return nil
+}
+
+// tierIndex returns the position in config.Tiers of the tier card belongs to.
+func tierIndex(card Card) int {
+	for i, tier := range config.Tiers {
+		if tier.matches(card) {
+			return i
+		}
+	}
+	return len(config.Tiers) - 1
+}
+
+func getEggTier(card Card) Tier {
+	return config.Tiers[tierIndex(card)]
+}
+
+// pool is the ids of one tier that a roll can land on. cumulative holds
+// the running total of the card weights, or is nil when every card is
+// equally likely.
+type pool struct {
+	Ids        []int
+	cumulative []float64
+}
+
+func newPool(ids []int, weight func(id int) float64) pool {
+	p := pool{Ids: ids}
+	if weight == nil {
+		return p
+	}
+	total := 0.0
+	p.cumulative = make([]float64, len(ids))
+	for i, id := range ids {
+		total += weight(id)
+		p.cumulative[i] = total
+	}
+	return p
+}
+
+func (p pool) pick() int {
+	if p.cumulative == nil {
+		return p.Ids[rand.Intn(len(p.Ids))]
+	}
+	n := rand.Float64() * p.cumulative[len(p.cumulative)-1]
+	return p.Ids[sort.Search(len(p.Ids), func(i int) bool { return p.cumulative[i] > n })]
+}
+
+// Pools holds one pool per tier, indexed like config.Tiers.
+type Pools []pool
+
+// weight is the weight of tier i, or zero if no card can be rolled from
+// it, so empty pools never swallow a roll.
+func (ps Pools) weight(i int) float64 {
+	if len(ps[i].Ids) == 0 {
+		return 0
+	}
+	return config.Tiers[i].Weight
+}
+
+// sum is the total weight of the first n tiers.
+func (ps Pools) sum(n int) (total float64) {
+	for i := 0; i < n; i++ {
+		total += ps.weight(i)
+	}
+	return total
+}
+
+func (ps Pools) total() float64 {
+	return ps.sum(len(ps))
+}
+
+func (ps Pools) rates() []Rate {
+	total := ps.total()
+	ret := make([]Rate, len(ps))
+	for i, tier := range config.Tiers {
+		ret[i] = Rate{tier.Name, tier.Label, 100 * ps.weight(i) / total, len(ps[i].Ids)}
+	}
+	return ret
+}
+
+// pickTier picks one of the first n tiers by weight.
+func (ps Pools) pickTier(n int) int {
+	x := rand.Float64() * ps.sum(n)
+	last := 0
+	for i := 0; i < n; i++ {
+		w := ps.weight(i)
+		if w == 0 {
+			continue
+		}
+		if x < w {
+			return i
+		}
+		x -= w
+		last = i
+	}
+	return last
+}
+
+// rollCard rolls from banner's pools, or the regular ones if banner is nil.
+// A guaranteed roll only picks from the pity tier or better, unless none of
+// those tiers has anything to roll.
+func rollCard(c *Catalog, banner *Banner, guaranteed bool) Card {
+	pools := c.poolsFor(banner)
+	n := len(pools)
+	if guaranteed && pools.sum(pityTier()+1) > 0 {
+		n = pityTier() + 1
+	}
+	return c.Cards[pools[pools.pickTier(n)].pick()]
+}
+
+// PityConfig guarantees an egg of Tier or better once a user has gone
+// Threshold rolls without one. A zero Threshold turns pity off.
+type PityConfig struct {
+	Threshold int    `json:"threshold"`
+	Tier      string `json:"tier"`
+}
+
+func validatePity(p PityConfig, tiers []Tier) error {
+	if p.Threshold < 0 {
+		return errors.New("pity threshold cannot be negative")
+	}
+	if p.Threshold > 0 && tierByName(tiers, p.Tier) < 0 {
+		return fmt.Errorf("pity tier %q is not a configured tier", p.Tier)
+	}
+	return nil
+}
+
+func tierByName(tiers []Tier, name string) int {
+	for i, tier := range tiers {
+		if tier.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func pityTier() int {
+	return tierByName(config.Tiers, config.Pity.Tier)
+}
+
+// pityRolls is how many rolls a user who has gone count rolls without a
+// pity tier egg has left until one is guaranteed, or 0 when pity is off.
+func pityRolls(count int) int {
+	if config.Pity.Threshold == 0 {
+		return 0
+	}
+	if count >= config.Pity.Threshold {
+		return 1
+	}
+	return config.Pity.Threshold - count
+}
+
+type RollResult struct {
+	Card       Card
+	Guaranteed bool
+}
+
+func formatRolls(user string, banner *Banner, results []RollResult) string {
+	title := "roll"
+	if banner != nil {
+		title = banner.Title + " roll"
+	}
+	if len(results) == 1 {
+		r := results[0]
+		resp := user + "'s " + title + ": " + getEggTier(r.Card).Label + " " + r.Card.Name
+		if r.Guaranteed {
+			resp = resp + " (pity)"
+		}
+		return resp
+	}
+	best := 0
+	parts := make([]string, len(results))
+	for i, r := range results {
+		parts[i] = fmt.Sprintf("%d) %s", i+1, r.Card.Name)
+		t := tierIndex(r.Card)
+		if t < len(config.Tiers)-1 {
+			parts[i] = parts[i] + " [" + strings.ToUpper(config.Tiers[t].Name) + "]"
+		}
+		if t < tierIndex(results[best].Card) {
+			best = i
+		}
+	}
+	return fmt.Sprintf("%s's %d %ss: %s. Best: %s %s",
+		user, len(results), title, strings.Join(parts, ", "), getEggTier(results[best].Card).Label, results[best].Card.Name)
+}
+
+func formatRates(rs []Rate, banner *Banner) string {
+	parts := make([]string, len(rs))
+	for i, r := range rs {
+		parts[i] = fmt.Sprintf("%s %.2f%%", strings.ToUpper(r.Tier), r.Percent)
+	}
+	if banner != nil {
+		return banner.Title + " rates: " + strings.Join(parts, ", ")
+	}
+	return "Current rates: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestValidateTiersOnlyLastTakesEverything(t *testing.T) {
+	if err := validateTiers(defaultTiers()); err != nil {
+		t.Errorf("default tiers: %v", err)
+	}
+	tiers := []Tier{
+		{Name: "gold", MinRarity: 7, Weight: 10},
+		{Name: "silver", Weight: 30},
+		{Name: "bronze", Weight: 60},
+	}
+	if err := validateTiers(tiers); err == nil {
+		t.Error("a catch-all tier before the last was accepted")
+	}
+	if err := validateTiers([]Tier{{Name: "any", Weight: 1}}); err != nil {
+		t.Errorf("a single catch-all tier: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+// migration is one step of the schema. Once released a migration must not
+// change; add a new one instead.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations are applied in order. The first ones use IF NOT EXISTS so
+// databases created before schema_migrations existed can adopt them.
+var migrations = []migration{
+	{1, "create users", []string{`
+	CREATE TABLE IF NOT EXISTS Users(
+		name TEXT PRIMARY KEY NOT NULL,
+		cards INT NOT NULL
+	)`}},
+	{2, "create user cards", []string{`
+	CREATE TABLE IF NOT EXISTS UserCards(
+		key SERIAL PRIMARY KEY NOT NULL,
+		id INT NOT NULL
+	)`}},
+	{3, "add user pity", []string{
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS pity INT NOT NULL DEFAULT 0`,
+	}},
+	// Boxes used to hold only the leader, referenced from Users.cards.
+	{4, "add user card owner", []string{
+		`ALTER TABLE UserCards ADD COLUMN IF NOT EXISTS owner TEXT`,
+		`UPDATE UserCards SET owner = Users.name FROM Users
+		WHERE UserCards.key = Users.cards AND UserCards.owner IS NULL`,
+	}},
+	{5, "create shouts", []string{`
+	CREATE TABLE Shouts(
+		id SERIAL PRIMARY KEY NOT NULL,
+		name TEXT NOT NULL,
+		leader INT NOT NULL,
+		message TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		received_at TIMESTAMPTZ NOT NULL,
+		displayed_at TIMESTAMPTZ
+	)`}},
+	// Everything from before channels existed goes to the default channel.
+	{6, "scope by channel", []string{
+		`ALTER TABLE Users ADD COLUMN channel TEXT NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE Users ALTER COLUMN channel DROP DEFAULT`,
+		`ALTER TABLE Users DROP CONSTRAINT users_pkey`,
+		`ALTER TABLE Users ADD PRIMARY KEY (channel, name)`,
+		`ALTER TABLE UserCards ADD COLUMN channel TEXT NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE UserCards ALTER COLUMN channel DROP DEFAULT`,
+		`CREATE INDEX usercards_channel ON UserCards (channel, owner)`,
+		`ALTER TABLE Shouts ADD COLUMN channel TEXT NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE Shouts ALTER COLUMN channel DROP DEFAULT`,
+		`CREATE INDEX shouts_channel ON Shouts (channel, id)`,
+	}},
+	{7, "add user monster points", []string{
+		`ALTER TABLE Users ADD COLUMN monster_points INT NOT NULL DEFAULT 0`,
+	}},
+	{8, "add user stones", []string{
+		`ALTER TABLE Users ADD COLUMN stones INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE Users ADD COLUMN last_daily DATE`,
+	}},
+	{9, "create rolls", []string{`
+	CREATE TABLE Rolls(
+		id SERIAL PRIMARY KEY NOT NULL,
+		channel TEXT NOT NULL,
+		name TEXT NOT NULL,
+		card INT NOT NULL,
+		tier TEXT NOT NULL,
+		banner TEXT NOT NULL DEFAULT '',
+		rolled_at TIMESTAMPTZ NOT NULL,
+		kept BOOLEAN NOT NULL DEFAULT false
+	)`,
+		`CREATE INDEX rolls_user ON Rolls (channel, name, id)`,
+	}},
+	{10, "add roll pity", []string{
+		`ALTER TABLE Rolls ADD COLUMN pity BOOLEAN NOT NULL DEFAULT false`,
+		`CREATE INDEX rolls_banner ON Rolls (channel, banner, rolled_at)`,
+	}},
+	{11, "add shout replay of", []string{
+		`ALTER TABLE Shouts ADD COLUMN replay_of INT REFERENCES Shouts (id)`,
+	}},
+}
+
+const createSchemaMigrations string = `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INT PRIMARY KEY NOT NULL,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`
+const selectSchemaVersion string = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+const lockSchemaMigrations string = `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`
+const insertSchemaMigration string = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+
+const selectStoredChannels string = `
+	SELECT channel FROM Users UNION SELECT channel FROM UserCards
+	UNION SELECT channel FROM Shouts UNION SELECT channel FROM Rolls`
+
+// channelTables are the tables whose rows belong to a channel.
+var channelTables = []string{"Users", "UserCards", "Shouts", "Rolls"}
+
+func latestMigration() int {
+	return migrations[len(migrations)-1].version
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(createSchemaMigrations)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow(selectSchemaVersion).Scan(&version)
+	return version, err
+}
+
+func pendingMigrations(version int) (ret []migration) {
+	for _, m := range migrations {
+		if m.version > version {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// checkSchema refuses to run against a database that a newer binary has
+// already migrated past what this one knows about.
+func checkSchema(version int) error {
+	if version > latestMigration() {
+		return fmt.Errorf("database schema is at version %d but this build only knows up to %d", version, latestMigration())
+	}
+	return nil
+}
+
+// applyMigration runs m and records it in one transaction. The table lock
+// makes a second process starting at the same time wait, then skip m.
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(lockSchemaMigrations)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = tx.QueryRow(selectSchemaVersion).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version >= m.version {
+		return nil
+	}
+	for _, stmt := range m.statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+	_, err = tx.Exec(insertSchemaMigration, m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDB brings the schema up to date, or only checks that it is when
+// apply is false.
+func migrateDB(db *sql.DB, apply bool) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if err = checkSchema(version); err != nil {
+		return err
+	}
+	pending := pendingMigrations(version)
+	if len(pending) > 0 && !apply {
+		return fmt.Errorf("database schema is at version %d, %d migrations pending; run migrate first", version, len(pending))
+	}
+	for _, m := range pending {
+		log.Printf("migrate: applying %d (%s)", m.version, m.name)
+		if err = applyMigration(db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkChannels refuses to run while the database holds rows for a
+// channel that is not configured. Everything from before channels existed
+// was moved to the default channel, which goes unused once channels are
+// configured, so this is how an upgrade would lose its users.
+func checkChannels(db *sql.DB, configured []ChannelConfig) error {
+	known := make(map[string]bool)
+	for _, c := range configured {
+		known[c.Name] = true
+	}
+	rows, err := db.Query(selectStoredChannels)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel string
+		if err = rows.Scan(&channel); err != nil {
+			return err
+		}
+		if !known[channel] {
+			return fmt.Errorf("database has data for channel %q, which is not configured; add it to channels or move it with \"migrate rename %s <channel>\"", channel, channel)
+		}
+	}
+	return rows.Err()
+}
+
+// renameChannel moves every row of channel from to channel to.
+func renameChannel(db *sql.DB, from string, to string) error {
+	if !channelName.MatchString(to) {
+		return fmt.Errorf("channel name %q may only use letters, digits, - and _", to)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range channelTables {
+		res, err := tx.Exec(`UPDATE `+table+` SET channel = $2 WHERE channel = $1`, from, to)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		log.Printf("migrate: moved %d rows of %s from %s to %s", n, table, from, to)
+	}
+	return tx.Commit()
+}
+
+// runMigrate is the migrate subcommand: "migrate" applies every pending
+// migration, "migrate status" lists them and "migrate rename <from> <to>"
+// moves a channel's data to another name.
+func runMigrate(args []string) {
+	db := openDB()
+	if len(args) > 0 && args[0] == "status" {
+		version, err := schemaVersion(db)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("schema version %d, latest known %d\n", version, latestMigration())
+		if err = checkSchema(version); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, m := range pendingMigrations(version) {
+			fmt.Printf("pending: %d %s\n", m.version, m.name)
+		}
+		return
+	}
+	if err := migrateDB(db, true); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("schema is up to date")
+	if len(args) > 0 && args[0] == "rename" {
+		if len(args) != 3 {
+			fmt.Println("usage: migrate rename <from> <to>")
+			os.Exit(1)
+		}
+		if err := renameChannel(db, args[1], args[2]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("moved channel %s to %s\n", args[1], args[2])
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ModerationConfig struct {
+	// BannedWords are matched as whole words, ignoring case.
+	BannedWords []string `json:"banned_words"`
+	BlockLinks  bool     `json:"block_links"`
+	// RequireApproval holds every shout that passes the filters until a
+	// moderator approves it on /admin/moderate.
+	RequireApproval bool `json:"require_approval"`
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.|\b[a-z0-9-]+\.(com|net|org|tv|gg|io|ly|me|co|be|us|uk)\b)`)
+
+func compileBannedWords(words []string) *regexp.Regexp {
+	if len(words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// filterShout returns why message may not be shouted, or "" if it may.
+func (ch *Channel) filterShout(message string) string {
+	if ch.bannedPattern != nil && ch.bannedPattern.MatchString(message) {
+		return "banned word " + strconv.Quote(ch.bannedPattern.FindString(message))
+	}
+	if ch.Moderation.BlockLinks && linkPattern.MatchString(message) {
+		return "link " + strconv.Quote(linkPattern.FindString(message))
+	}
+	return ""
+}
+
+func logRejection(s ShouterUi, by string, reason string) {
+	log.Printf("moderation: rejected %s's shout %q (%s): %s", s.Name, s.Message, by, reason)
+}
+
+// PendingShout is a shout waiting for a moderator.
+type PendingShout struct {
+	Id       int
+	RecordId int
+	Received time.Time
+	ShouterUi
+}
+
+type moderationQueue struct {
+	sync.Mutex
+	ch      *Channel
+	nextId  int
+	pending []PendingShout
+}
+
+// add holds s for a moderator and returns its place in line. A full queue
+// follows the same overflow policy as the shout broker.
+func (q *moderationQueue) add(s ShouterUi, recordId int) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	policy := q.ch.Shouts.Overflow
+	if policy == overflowOnePerUser {
+		for _, p := range q.pending {
+			if p.Name == s.Name {
+				return 0, errShoutPending
+			}
+		}
+	}
+	if len(q.pending) >= q.ch.Shouts.Capacity {
+		if policy != overflowDropOldest {
+			return 0, errShoutQueueFull
+		}
+		oldest := q.pending[0]
+		log.Printf("moderation: queue full, dropping %s's shout %q", oldest.Name, oldest.Message)
+		go q.ch.updateShout(oldest.RecordId, outcomeDropped, oldest.Message, "queue full")
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, PendingShout{q.nextId, recordId, time.Now(), s})
+	q.nextId++
+	return len(q.pending), nil
+}
+
+func (q *moderationQueue) list() []PendingShout {
+	q.Lock()
+	defer q.Unlock()
+	return append([]PendingShout(nil), q.pending...)
+}
+
+// take removes and returns the pending shout with id.
+func (q *moderationQueue) take(id int) (PendingShout, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for i, p := range q.pending {
+		if p.Id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return p, true
+		}
+	}
+	return PendingShout{}, false
+}
+
+// putBack returns a shout that could not be released to the front.
+func (q *moderationQueue) putBack(p PendingShout) {
+	q.Lock()
+	defer q.Unlock()
+	q.pending = append([]PendingShout{p}, q.pending...)
+}
+
+// skip moves the pending shout with id to the back of the list.
+func (q *moderationQueue) skip(id int) bool {
+	q.Lock()
+	defer q.Unlock()
+	for i, p := range q.pending {
+		if p.Id == id {
+			q.pending = append(append(q.pending[:i], q.pending[i+1:]...), p)
+			return true
+		}
+	}
+	return false
+}
+
+func viewModerate(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	ctx.HTML(200, "moderate.tmpl", gin.H{
+		"Pending": ch.moderation.list(),
+		"Channel": ch.Name,
+		"Token":   ctx.Query("token"),
+		"Error":   ctx.Query("error"),
+	})
+}
+
+// decision applies a moderator's action to a pending shout and goes back
+// to the moderation page.
+func decision(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	back := func(problem string) {
+		q := url.Values{channelParam: {ch.Name}, "token": {ctx.Query("token")}}
+		if problem != "" {
+			q.Set("error", problem)
+		}
+		ctx.Redirect(303, "moderate?"+q.Encode())
+	}
+	id, err := strconv.Atoi(ctx.Query("id"))
+	if err != nil {
+		back("Invalid shout id.")
+		return
+	}
+	action := ctx.Query("action")
+	message := ctx.Query(messageParam)
+	switch action {
+	case "skip":
+		if !ch.moderation.skip(id) {
+			back("That shout is no longer pending.")
+			return
+		}
+		back("")
+		return
+	case "approve", "reject":
+	case "edit":
+		if message == "" || len(message) > 100 {
+			back("Messages must be between 1 and 100 characters.")
+			return
+		}
+	default:
+		back("Unknown action.")
+		return
+	}
+
+	p, ok := ch.moderation.take(id)
+	if !ok {
+		back("That shout is no longer pending.")
+		return
+	}
+	if action == "reject" {
+		reason := ctx.Query("reason")
+		if reason == "" {
+			reason = "no reason given"
+		}
+		logRejection(p.ShouterUi, "moderator", reason)
+		ch.updateShout(p.RecordId, outcomeRejected, p.Message, reason)
+		back("")
+		return
+	}
+	original := p.Message
+	if action == "edit" {
+		p.Message = message
+	}
+	if _, err := ch.shouts.enqueue(Shout{RecordId: p.RecordId, ShouterUi: p.ShouterUi}); err != nil {
+		p.Message = original
+		ch.moderation.putBack(p)
+		back(fmt.Sprintf("Could not queue the shout: %v.", err))
+		return
+	}
+	if action == "edit" {
+		ch.updateShout(p.RecordId, outcomeEdited, p.Message, "was: "+original)
+	} else {
+		ch.updateShout(p.RecordId, outcomeApproved, p.Message, "")
+	}
+	back("")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestModerationQueueOverflow(t *testing.T) {
+	store := newMemStore()
+	ch := newTestChannel(t, store)
+	ch.Shouts.Capacity = 2
+	var ids []int
+	for _, name := range []string{"mia", "leo", "ada"} {
+		id, err := store.RecordShout(ShoutRecord{Name: name, Message: "hi", Outcome: outcomePending, Received: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	ch.Shouts.Overflow = overflowReject
+	ch.moderation.add(ShouterUi{Name: "mia", Message: "hi"}, ids[0])
+	ch.moderation.add(ShouterUi{Name: "leo", Message: "hi"}, ids[1])
+	if _, err := ch.moderation.add(ShouterUi{Name: "ada", Message: "hi"}, ids[2]); err != errShoutQueueFull {
+		t.Fatalf("rejecting when full: %v", err)
+	}
+
+	ch.Shouts.Overflow = overflowDropOldest
+	place, err := ch.moderation.add(ShouterUi{Name: "ada", Message: "hi"}, ids[2])
+	if err != nil || place != 2 {
+		t.Fatalf("dropping the oldest when full: place %d, %v", place, err)
+	}
+	pending := ch.moderation.list()
+	if len(pending) != 2 || pending[0].Name != "leo" || pending[1].Name != "ada" {
+		t.Fatalf("pending after dropping the oldest: %+v", pending)
+	}
+	var dropped ShoutRecord
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if dropped, err = store.GetShout(ids[0]); err == nil && dropped.Outcome == outcomeDropped {
+			break
+		}
+	}
+	if dropped.Outcome != outcomeDropped {
+		t.Errorf("dropped shout recorded as %+v", dropped)
+	}
+}
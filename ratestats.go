@@ -0,0 +1,272 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"math"
+	"strconv"
+	"time"
+)
+
+const windowParam string = "window"
+const sinceParam string = "since"
+const untilParam string = "until"
+const simulateParam string = "simulate"
+
+// maxSimulated caps ?simulate=, which only admins may use since every
+// roll costs CPU.
+const maxSimulated int = 1000000
+
+// minExpected is the fewest rolls every tier should expect before the
+// chi-square test means much.
+const minExpected float64 = 5
+
+// TierStat compares how often one tier hatched with how often it should.
+// Configured and Observed are percentages.
+type TierStat struct {
+	Tier       string  `json:"tier"`
+	Label      string  `json:"label"`
+	Configured float64 `json:"configured"`
+	Observed   float64 `json:"observed"`
+	Count      int     `json:"count"`
+	Expected   float64 `json:"expected"`
+}
+
+// RateReport tests the rolls on one banner, or on the standard rates when
+// Banner is empty, against the rates configured now. Pity rolls are left
+// out since pity decided them, not the rates.
+type RateReport struct {
+	Banner    string     `json:"banner"`
+	Title     string     `json:"title"`
+	Since     *time.Time `json:"since"`
+	Until     time.Time  `json:"until"`
+	Simulated bool       `json:"simulated"`
+	Rolls     int        `json:"rolls"`
+	Tiers     []TierStat `json:"tiers"`
+	// ChiSquare is the goodness of fit over Freedom degrees of freedom,
+	// and P the chance of rolls at least this far from the configured
+	// rates if the rates are honest.
+	ChiSquare float64 `json:"chi_square"`
+	Freedom   int     `json:"degrees_of_freedom"`
+	P         float64 `json:"p"`
+	Verdict   string  `json:"verdict"`
+}
+
+func newRateReport(banner *Banner, rates []Rate, counts map[string]int) RateReport {
+	r := RateReport{Title: "Standard"}
+	if banner != nil {
+		r.Banner, r.Title = banner.Name, banner.Title
+	}
+	for _, n := range counts {
+		r.Rolls += n
+	}
+	impossible := false
+	few := false
+	tiers := 0
+	for _, rate := range rates {
+		t := TierStat{Tier: rate.Tier, Label: rate.Label, Configured: rate.Percent, Count: counts[rate.Tier]}
+		t.Expected = float64(r.Rolls) * rate.Percent / 100
+		if r.Rolls > 0 {
+			t.Observed = 100 * float64(t.Count) / float64(r.Rolls)
+		}
+		if t.Expected > 0 {
+			r.ChiSquare += (float64(t.Count) - t.Expected) * (float64(t.Count) - t.Expected) / t.Expected
+			few = few || t.Expected < minExpected
+			tiers++
+		} else if t.Count > 0 {
+			impossible = true
+		}
+		r.Tiers = append(r.Tiers, t)
+	}
+	r.Freedom = tiers - 1
+	r.P = chiSquareP(r.ChiSquare, r.Freedom)
+	switch {
+	case r.Rolls == 0:
+		r.Verdict = "No rolls to compare yet."
+	case impossible:
+		r.P = 0
+		r.Verdict = "Some rolls hatched as tiers that cannot be rolled now; the rates or catalog have changed."
+	case few:
+		r.Verdict = "Too few rolls to judge yet."
+	case r.P < 0.001:
+		r.Verdict = "Very unlikely under the configured rates."
+	case r.P < 0.05:
+		r.Verdict = "Somewhat unlikely under the configured rates, worth keeping an eye on."
+	default:
+		r.Verdict = "Consistent with the configured rates."
+	}
+	return r
+}
+
+// chiSquareP is the chance of a chi-square statistic of at least x with df
+// degrees of freedom.
+func chiSquareP(x float64, df int) float64 {
+	if df < 1 {
+		return 1
+	}
+	return gammaQ(float64(df)/2, x/2)
+}
+
+// gammaQ is the regularized upper incomplete gamma function, from its
+// series below a+1 and its continued fraction above.
+func gammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+	front := math.Exp(-x + a*math.Log(x) - lg)
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if term < sum*1e-15 {
+				break
+			}
+		}
+		return math.Max(0, 1-sum*front)
+	}
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < 1e-15 {
+			break
+		}
+	}
+	return front * h
+}
+
+// simulateRolls counts n rolls on banner by tier, as rolled without pity.
+func simulateRolls(c *Catalog, banner *Banner, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[getEggTier(rollCard(c, banner, false)).Name]++
+	}
+	return counts
+}
+
+// rateReport builds the report the query asks for: ?banner= picks the
+// banner, running or not, and ?window= (like "24h") or ?since= and
+// ?until= (RFC 3339) the rolls. ?simulate=N rolls N eggs instead of
+// looking at recorded rolls; the caller checks it comes with the admin
+// token. It returns what is wrong with the query, or an error if the
+// rolls could not be loaded.
+func rateReport(ctx *gin.Context) (RateReport, string, error) {
+	var banner *Banner
+	if name := ctx.Query(bannerParam); name != "" {
+		var ok bool
+		if banner, ok = findBanner(name); !ok {
+			return RateReport{}, "There is no banner called " + name + ".", nil
+		}
+	}
+	c := currentCatalog()
+	rates := c.poolsFor(banner).rates()
+	now := time.Now()
+
+	if s := ctx.Query(simulateParam); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSimulated {
+			return RateReport{}, "simulate must be 1 to " + strconv.Itoa(maxSimulated) + ".", nil
+		}
+		r := newRateReport(banner, rates, simulateRolls(c, banner, n))
+		r.Simulated = true
+		r.Until = now
+		return r, "", nil
+	}
+
+	var since time.Time
+	until := now
+	if w := ctx.Query(windowParam); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return RateReport{}, "window must be a duration like 24h.", nil
+		}
+		since = now.Add(-d)
+	}
+	if s := ctx.Query(sinceParam); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return RateReport{}, "since must be a time like 2026-01-02T15:04:05Z.", nil
+		}
+		since = t
+	}
+	if s := ctx.Query(untilParam); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return RateReport{}, "until must be a time like 2026-01-02T15:04:05Z.", nil
+		}
+		until = t
+	}
+	name := ""
+	if banner != nil {
+		name = banner.Name
+	}
+	counts, err := channelOf(ctx).store.RollStats(name, since, until)
+	if err != nil {
+		return RateReport{}, "", err
+	}
+	r := newRateReport(banner, rates, counts)
+	if !since.IsZero() {
+		r.Since = &since
+	}
+	r.Until = until
+	return r, "", nil
+}
+
+func rateStats(ctx *gin.Context) {
+	if ctx.Query(simulateParam) != "" && !isAdmin(ctx) {
+		ctx.JSON(403, gin.H{"error": "Only admins may simulate rolls."})
+		return
+	}
+	r, problem, err := rateReport(ctx)
+	if problem != "" {
+		ctx.JSON(400, gin.H{"error": problem})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(200, r)
+}
+
+func viewRateStats(ctx *gin.Context) {
+	admin := isAdmin(ctx)
+	if ctx.Query(simulateParam) != "" && !admin {
+		ctx.String(403, "Only admins may simulate rolls.")
+		return
+	}
+	r, problem, err := rateReport(ctx)
+	if problem != "" {
+		ctx.String(400, problem)
+		return
+	}
+	if err != nil {
+		ctx.String(500, err.Error())
+		return
+	}
+	h := gin.H{
+		"Report":  r,
+		"Banners": config.Banners,
+		"Channel": channelOf(ctx).Name,
+	}
+	if admin {
+		h["Token"] = ctx.Query("token")
+	}
+	ctx.HTML(200, "ratestats.tmpl", h)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOnlyAdminsSimulate(t *testing.T) {
+	ch := newTestChannel(t, newMemStore())
+	channels = map[string]*Channel{ch.Name: ch}
+	defaultChannel = ch
+	config.AdminToken = "secret"
+	r := gin.New()
+	r.GET("/ratestats", withChannel, rateStats)
+	r.GET("/viewratestats", withChannel, viewRateStats)
+
+	for url, want := range map[string]int{
+		"/ratestats?simulate=100":                   403,
+		"/ratestats?simulate=100&token=wrong":       403,
+		"/viewratestats?simulate=100":               403,
+		"/ratestats":                                200,
+		"/ratestats?simulate=100&token=secret":      200,
+		"/ratestats?simulate=10000000&token=secret": 400,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != want {
+			t.Errorf("%s answered %d, want %d", url, w.Code, want)
+		}
+	}
+}
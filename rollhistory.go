@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RollRecord is one egg in a user's roll history. Card is a card id, Tier
+// the name of the tier it hatched as and Banner the name of the banner it
+// was rolled on, empty for the standard rates. Pity is set when the roll
+// was guaranteed.
+type RollRecord struct {
+	Id     int       `json:"id"`
+	Name   string    `json:"name"`
+	Card   int       `json:"card"`
+	Tier   string    `json:"tier"`
+	Banner string    `json:"banner"`
+	Pity   bool      `json:"pity"`
+	Rolled time.Time `json:"rolled"`
+	Kept   bool      `json:"kept"`
+}
+
+// TierCount is how many of a user's rolls hatched as one tier.
+type TierCount struct {
+	Tier  string `json:"tier"`
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+const rollsPerPage int = 25
+
+// historyLength is how many rolls the history command lists.
+const historyLength int = 5
+
+// tierCounts orders counts like config.Tiers, followed by tiers that are
+// no longer configured.
+func tierCounts(counts map[string]int) []TierCount {
+	var ret []TierCount
+	seen := make(map[string]bool)
+	for _, tier := range config.Tiers {
+		ret = append(ret, TierCount{tier.Name, tier.Label, counts[tier.Name]})
+		seen[tier.Name] = true
+	}
+	var gone []string
+	for name := range counts {
+		if !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	sort.Strings(gone)
+	for _, name := range gone {
+		ret = append(ret, TierCount{name, name, counts[name]})
+	}
+	return ret
+}
+
+func cardName(c *Catalog, id int) string {
+	if card, ok := c.Cards[id]; ok {
+		return card.Name
+	}
+	return fmt.Sprintf("#%d", id)
+}
+
+// history sums up the user's last few rolls and what all their rolls
+// hatched as.
+func history(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
+	}
+	ch.users.RLock()
+	_, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return user + " has not been scammed yet."
+	}
+	rolls, total, err := ch.store.RollHistory(user, 0, historyLength)
+	if err != nil {
+		return storeFailed(user, err)
+	}
+	if total == 0 {
+		return user + " has not rolled yet."
+	}
+	counts, err := ch.store.RollTiers(user)
+	if err != nil {
+		return storeFailed(user, err)
+	}
+	c := currentCatalog()
+	lowest := config.Tiers[len(config.Tiers)-1].Name
+	parts := make([]string, len(rolls))
+	for i, r := range rolls {
+		parts[i] = cardName(c, r.Card)
+		if r.Tier != lowest {
+			parts[i] = parts[i] + " [" + strings.ToUpper(r.Tier) + "]"
+		}
+		if r.Kept {
+			parts[i] = parts[i] + " (kept)"
+		}
+	}
+	var tiers []string
+	for _, t := range tierCounts(counts) {
+		if t.Count > 0 {
+			tiers = append(tiers, fmt.Sprintf("%d %s", t.Count, t.Tier))
+		}
+	}
+	return fmt.Sprintf("%s's last %d rolls: %s. %d rolls in all: %s.",
+		user, len(rolls), strings.Join(parts, ", "), total, strings.Join(tiers, ", "))
+}
+
+// userRolls loads one page of user's history and their tier counts.
+func userRolls(ch *Channel, user string, page int) ([]RollRecord, int, []TierCount, error) {
+	rolls, total, err := ch.store.RollHistory(user, (page-1)*rollsPerPage, rollsPerPage)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	counts, err := ch.store.RollTiers(user)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return rolls, total, tierCounts(counts), nil
+}
+
+func rollHistory(ctx *gin.Context) {
+	user := ctx.Query(userParam)
+	if user == "" {
+		ctx.JSON(400, gin.H{"error": "Invalid user."})
+		return
+	}
+	page := queryPage(ctx)
+	rolls, total, tiers, err := userRolls(channelOf(ctx), user, page)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(200, gin.H{"user": user, "page": page, "per_page": rollsPerPage, "total": total, "tiers": tiers, "rolls": rolls})
+}
+
+func viewRollHistory(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	user := ctx.Query(userParam)
+	if user == "" {
+		ctx.String(400, "Invalid user.")
+		return
+	}
+	page := queryPage(ctx)
+	rolls, total, tiers, err := userRolls(ch, user, page)
+	if err != nil {
+		ctx.String(500, err.Error())
+		return
+	}
+	c := currentCatalog()
+	names := make(map[int]string)
+	for _, r := range rolls {
+		names[r.Card] = cardName(c, r.Card)
+	}
+	h := gin.H{
+		"User":    user,
+		"Channel": ch.Name,
+		"Rolls":   rolls,
+		"Names":   names,
+		"Tiers":   tiers,
+		"Total":   total,
+		"Page":    page,
+	}
+	if page > 1 {
+		h["Prev"] = page - 1
+	}
+	if page*rollsPerPage < total {
+		h["Next"] = page + 1
+	}
+	ctx.HTML(200, "rollhistory.tmpl", h)
+}
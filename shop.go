@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ShopItem is a card users can buy with monster points.
+type ShopItem struct {
+	Id    int `json:"id"`
+	Price int `json:"price"`
+}
+
+func validateShop(items []ShopItem) error {
+	seen := make(map[int]bool)
+	for _, item := range items {
+		if item.Price <= 0 {
+			return fmt.Errorf("shop card %d needs a positive price", item.Id)
+		}
+		if seen[item.Id] {
+			return fmt.Errorf("shop lists card %d twice", item.Id)
+		}
+		seen[item.Id] = true
+	}
+	return nil
+}
+
+// shopCard returns the card item sells, unless it is not in the catalog or
+// costs less than it sells for, which would let buying and selling it
+// make monster points.
+func shopCard(c *Catalog, item ShopItem) (Card, bool) {
+	card, ok := c.Cards[item.Id]
+	if !ok || item.Price < card.Monster_points {
+		return Card{}, false
+	}
+	return card, true
+}
+
+// checkShop logs the shop items c leaves off sale. The catalog is only
+// known once loaded, so validateShop cannot catch these.
+func checkShop(c *Catalog) {
+	for _, item := range config.Shop {
+		card, ok := c.Cards[item.Id]
+		if !ok {
+			log.Printf("shop: card %d is not in the catalog and is off sale", item.Id)
+		} else if item.Price < card.Monster_points {
+			log.Printf("shop: %s costs %d MP but sells for %d, so it is off sale", card.Name, item.Price, card.Monster_points)
+		}
+	}
+}
+
+// formatShop lists the items by their place in config.Shop, leaving out
+// cards that are off sale.
+func formatShop(c *Catalog) string {
+	var parts []string
+	for i, item := range config.Shop {
+		if card, ok := shopCard(c, item); ok {
+			parts = append(parts, fmt.Sprintf("%d) %s %d MP", i+1, card.Name, item.Price))
+		}
+	}
+	if len(parts) == 0 {
+		return "The shop is empty"
+	}
+	return "Shop: " + strings.Join(parts, ", ")
+}
+
+func showShop(ch *Channel, args url.Values) string {
+	resp := formatShop(currentCatalog())
+	user := args.Get(userParam)
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if userExists {
+		userInfo.Box.RLock()
+		resp = resp + ". " + user + " has " + strconv.Itoa(userInfo.MonsterPoints) + " MP"
+		userInfo.Box.RUnlock()
+	}
+	return resp + "."
+}
+
+// sell turns a card from the user's box, or one of their new cards, into
+// its monster points.
+func sell(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
+	}
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return user + " has not been scammed yet."
+	}
+	cards := currentCatalog().Cards
+	userInfo.Box.Lock()
+	defer userInfo.Box.Unlock()
+
+	if n := args.Get(pendingParam); n != "" {
+		pending := len(userInfo.Box.Pending)
+		choice, err := strconv.Atoi(n)
+		if err != nil || choice < 1 || choice > pending {
+			if pending == 0 {
+				return user + " does not have a new card to sell."
+			}
+			return user + " can only sell new cards 1 to " + strconv.Itoa(pending) + "."
+		}
+		card := cards[userInfo.Box.Pending[choice-1].Id]
+		balance, err := ch.store.AddMonsterPoints(user, card.Monster_points)
+		if err != nil {
+			return storeFailed(user, err)
+		}
+		userInfo.MonsterPoints = balance
+		userInfo.Box.Pending = append(userInfo.Box.Pending[:choice-1], userInfo.Box.Pending[choice:]...)
+		return fmt.Sprintf("%s sold %s for %d MP and now has %d MP.", user, card.Name, card.Monster_points, balance)
+	}
+
+	i, problem := boxSlot(args, userInfo)
+	if problem != "" {
+		return problem
+	}
+	if i == 0 {
+		return user + " cannot sell their leader."
+	}
+	owned := userInfo.Box.UserCards[i]
+	card := cards[owned.Id]
+	balance, err := ch.store.SellCard(user, owned, card.Monster_points)
+	if err != nil {
+		return storeFailed(user, err)
+	}
+	userInfo.MonsterPoints = balance
+	userInfo.Box.UserCards = append(userInfo.Box.UserCards[:i], userInfo.Box.UserCards[i+1:]...)
+	return fmt.Sprintf("%s sold %s for %d MP and now has %d MP.", user, card.Name, card.Monster_points, balance)
+}
+
+func buy(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
+	}
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return user + " has not been scammed yet."
+	}
+	n, err := strconv.Atoi(args.Get(itemParam))
+	if err != nil || n < 1 || n > len(config.Shop) {
+		return user + " can only buy items 1 to " + strconv.Itoa(len(config.Shop)) + " from the shop."
+	}
+	item := config.Shop[n-1]
+	card, ok := shopCard(currentCatalog(), item)
+	if !ok {
+		return "That card is not for sale right now."
+	}
+	userInfo.Box.Lock()
+	defer userInfo.Box.Unlock()
+	if userInfo.Box.full() {
+		return user + "'s box space is full."
+	}
+	if userInfo.MonsterPoints < item.Price {
+		return fmt.Sprintf("%s needs %d MP for %s but only has %d MP.", user, item.Price, card.Name, userInfo.MonsterPoints)
+	}
+	bought, balance, err := ch.store.BuyCard(user, item.Id, item.Price)
+	if err == errNotEnoughPoints {
+		return fmt.Sprintf("%s needs %d MP for %s but only has %d MP.", user, item.Price, card.Name, userInfo.MonsterPoints)
+	}
+	if err != nil {
+		return storeFailed(user, err)
+	}
+	userInfo.MonsterPoints = balance
+	userInfo.Box.UserCards = append(userInfo.Box.UserCards, bought)
+	return fmt.Sprintf("%s bought %s for %d MP and has %d MP left.", user, card.Name, item.Price, balance)
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestShopRefusesCardsCheaperThanTheySell(t *testing.T) {
+	store := newMemStore()
+	ch := newTestChannel(t, store)
+	// Ra sells for 5000 MP.
+	config.Shop = []ShopItem{{Id: 4, Price: 100}, {Id: 2, Price: 50}}
+	scam(ch, userArgs("mia"))
+	mia := boxOf(t, ch, "mia")
+	balance, err := store.AddMonsterPoints("mia", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mia.MonsterPoints = balance
+
+	if got := formatShop(currentCatalog()); got != "Shop: 2) Tamadra 50 MP" {
+		t.Errorf("shop lists %q", got)
+	}
+	if got := buy(ch, userArgs("mia", itemParam, "1")); got != "That card is not for sale right now." {
+		t.Errorf("buying Ra: %q", got)
+	}
+	if got := buy(ch, userArgs("mia", itemParam, "2")); got != "mia bought Tamadra for 50 MP and has 950 MP left." {
+		t.Fatalf("buying Tamadra: %q", got)
+	}
+	sell(ch, userArgs("mia", cardParam, "2"))
+	if mia.MonsterPoints > 1000 {
+		t.Errorf("buying and selling made %d MP", mia.MonsterPoints-1000)
+	}
+}
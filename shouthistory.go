@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// What happened to a shout, as kept in its history record.
+const (
+	outcomeAccepted  string = "accepted"
+	outcomePending   string = "pending"
+	outcomeApproved  string = "approved"
+	outcomeEdited    string = "edited"
+	outcomeRejected  string = "rejected"
+	outcomeFiltered  string = "filtered"
+	outcomeDropped   string = "dropped"
+	outcomeQueueFull string = "queue_full"
+	outcomeDuplicate string = "duplicate"
+	outcomeReplayed  string = "replayed"
+)
+
+// ShoutRecord is one shout in the history. Leader is a card id. A replay
+// gets a record of its own, with ReplayOf the id of the shout it repeats.
+// Displayed is when an overlay first acknowledged playing it.
+type ShoutRecord struct {
+	Id        int        `json:"id"`
+	Name      string     `json:"name"`
+	Leader    int        `json:"leader"`
+	Message   string     `json:"message"`
+	Outcome   string     `json:"outcome"`
+	Reason    string     `json:"reason"`
+	ReplayOf  int        `json:"replay_of"`
+	Received  time.Time  `json:"received"`
+	Displayed *time.Time `json:"displayed"`
+}
+
+const shoutsPerPage int = 25
+
+// History writes never stop a shout; failures are only logged, and a
+// record id of 0 means the shout was not recorded.
+
+func (ch *Channel) recordShout(s ShouterUi, outcome string, reason string) int {
+	id, err := ch.store.RecordShout(ShoutRecord{
+		Name:     s.Name,
+		Leader:   s.Leader.Id,
+		Message:  s.Message,
+		Outcome:  outcome,
+		Reason:   reason,
+		Received: time.Now(),
+	})
+	if err != nil {
+		log.Printf("store: recording %s's shout: %v", s.Name, err)
+		return 0
+	}
+	return id
+}
+
+func (ch *Channel) updateShout(id int, outcome string, message string, reason string) {
+	if id == 0 {
+		return
+	}
+	if err := ch.store.UpdateShout(id, outcome, message, reason); err != nil {
+		log.Printf("store: updating shout %d: %v", id, err)
+	}
+}
+
+func (ch *Channel) shoutDisplayed(id int) {
+	if id == 0 {
+		return
+	}
+	if err := ch.store.ShoutDisplayed(id, time.Now()); err != nil {
+		log.Printf("store: marking shout %d displayed: %v", id, err)
+	}
+}
+
+func queryPage(ctx *gin.Context) int {
+	page, err := strconv.Atoi(ctx.Query("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+func shoutHistory(ctx *gin.Context) {
+	page := queryPage(ctx)
+	records, total, err := channelOf(ctx).store.ShoutHistory((page-1)*shoutsPerPage, shoutsPerPage)
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(200, gin.H{"page": page, "per_page": shoutsPerPage, "total": total, "shouts": records})
+}
+
+func viewShoutHistory(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	page := queryPage(ctx)
+	records, total, err := ch.store.ShoutHistory((page-1)*shoutsPerPage, shoutsPerPage)
+	if err != nil {
+		ctx.String(500, err.Error())
+		return
+	}
+	h := gin.H{
+		"Shouts":  records,
+		"Page":    page,
+		"Channel": ch.Name,
+		"Token":   ctx.Query("token"),
+		"Error":   ctx.Query("error"),
+	}
+	if page > 1 {
+		h["Prev"] = page - 1
+	}
+	if page*shoutsPerPage < total {
+		h["Next"] = page + 1
+	}
+	ctx.HTML(200, "shouthistory.tmpl", h)
+}
+
+// replay queues a past shout for the overlay again, bypassing moderation
+// since the streamer picked it by hand. The replay is recorded as a new
+// shout so the original keeps its outcome and display time.
+func replay(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	back := func(problem string) {
+		q := url.Values{channelParam: {ch.Name}, "token": {ctx.Query("token")}, "page": {strconv.Itoa(queryPage(ctx))}}
+		if problem != "" {
+			q.Set("error", problem)
+		}
+		ctx.Redirect(303, "shouts?"+q.Encode())
+	}
+	id, err := strconv.Atoi(ctx.Query("id"))
+	if err != nil {
+		back("Invalid shout id.")
+		return
+	}
+	rec, err := ch.store.GetShout(id)
+	if err != nil {
+		back("Could not load that shout.")
+		return
+	}
+	replayId, err := ch.store.RecordShout(ShoutRecord{
+		Name:     rec.Name,
+		Leader:   rec.Leader,
+		Message:  rec.Message,
+		Outcome:  outcomeReplayed,
+		ReplayOf: rec.Id,
+		Received: time.Now(),
+	})
+	if err != nil {
+		log.Printf("store: recording the replay of shout %d: %v", rec.Id, err)
+		replayId = 0
+	}
+	s := ShouterUi{rec.Name, UserCard{Id: rec.Leader}, rec.Message}
+	if _, err = ch.shouts.enqueue(Shout{RecordId: replayId, ShouterUi: s}); err != nil {
+		outcome := outcomeQueueFull
+		if err == errShoutPending {
+			outcome = outcomeDuplicate
+		}
+		ch.updateShout(replayId, outcome, rec.Message, "replay")
+		back("Could not queue the shout: " + err.Error() + ".")
+		return
+	}
+	back("")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplayRecordsANewShout(t *testing.T) {
+	store := newMemStore()
+	ch := newTestChannel(t, store)
+	channels = map[string]*Channel{ch.Name: ch}
+	defaultChannel = ch
+	original := ShoutRecord{Name: "mia", Leader: 1, Message: "hi", Outcome: outcomeRejected, Reason: "rude", Received: time.Now()}
+	id, err := store.RecordShout(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original.Id = id
+	// An overlay has to be watching for the replay to go on air.
+	client, released, _ := ch.shouts.subscribe(0)
+	defer ch.shouts.unsubscribe(client)
+
+	r := gin.New()
+	r.GET("/replay", withChannel, replay)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/replay?id=1", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("replay answered %d", w.Code)
+	}
+
+	var onAir Shout
+	select {
+	case onAir = <-released:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the replay never went on air")
+	}
+	// It only counts as displayed once the overlay has played it.
+	time.Sleep(50 * time.Millisecond)
+	if replayed, err := store.GetShout(onAir.RecordId); err != nil || replayed.Displayed != nil {
+		t.Fatalf("replay before its ack recorded as %+v, %v", replayed, err)
+	}
+	ch.shouts.ack(client, onAir.Id)
+
+	var replayed ShoutRecord
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if replayed, err = store.GetShout(2); err == nil && replayed.Displayed != nil {
+			break
+		}
+	}
+	if replayed.Outcome != outcomeReplayed || replayed.ReplayOf != id || replayed.Displayed == nil {
+		t.Errorf("replay recorded as %+v", replayed)
+	}
+	got, err := store.GetShout(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Outcome != original.Outcome || got.Reason != original.Reason || got.Displayed != nil {
+		t.Errorf("original changed to %+v", got)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/manucorporat/sse"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Overflow policies for a full shout queue.
+const (
+	overflowReject     string = "reject"
+	overflowDropOldest string = "drop_oldest"
+	// overflowOnePerUser rejects when full, and also rejects users who
+	// already have a shout waiting.
+	overflowOnePerUser string = "one_per_user"
+)
+
+// Shout is a queued ShouterUi. Id is what overlays use to resume and is
+// assigned on release; RecordId is its entry in the shout history.
+type Shout struct {
+	Id       int
+	RecordId int
+	ShouterUi
+}
+
+// shoutBroker releases queued shouts one at a time to every connected
+// overlay. The next shout is held back until every overlay that was sent
+// the current one has acknowledged it, or the ack timeout passes; played
+// records whether any of them has. Recent shouts are kept so a
+// reconnecting overlay can catch up.
+type shoutBroker struct {
+	sync.Mutex
+	ch         *Channel
+	nextId     int
+	queue      []Shout
+	onAir      *Shout
+	waiting    map[int]bool
+	played     bool
+	history    []Shout
+	size       int
+	nextClient int
+	clients    map[int]chan Shout
+}
+
+func newShoutBroker(ch *Channel, size int) *shoutBroker {
+	return &shoutBroker{ch: ch, nextId: 1, size: size, clients: make(map[int]chan Shout)}
+}
+
+var errShoutQueueFull = errors.New("shout queue is full")
+var errShoutPending = errors.New("user already has a shout queued")
+
+// enqueue adds s to the queue and returns its place in line, 1 being next.
+// When the queue is at capacity the overflow policy decides what happens.
+func (b *shoutBroker) enqueue(s Shout) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	policy := b.ch.Shouts.Overflow
+	if policy == overflowOnePerUser {
+		for _, queued := range b.queue {
+			if queued.Name == s.Name {
+				return 0, errShoutPending
+			}
+		}
+	}
+	if len(b.queue) >= b.ch.Shouts.Capacity {
+		if policy != overflowDropOldest {
+			return 0, errShoutQueueFull
+		}
+		log.Printf("shouts: queue full, dropping %s's shout %q", b.queue[0].Name, b.queue[0].Message)
+		go b.ch.updateShout(b.queue[0].RecordId, outcomeDropped, b.queue[0].Message, "queue full")
+		b.queue = b.queue[1:]
+	}
+	b.queue = append(b.queue, s)
+	place := len(b.queue)
+	if b.onAir != nil {
+		place++
+	}
+	b.release()
+	return place, nil
+}
+
+// release puts the next queued shout on air if nothing is playing and
+// someone is watching. The caller must hold the lock.
+func (b *shoutBroker) release() {
+	if b.onAir != nil || len(b.queue) == 0 || len(b.clients) == 0 {
+		return
+	}
+	shout := b.queue[0]
+	shout.Id = b.nextId
+	b.nextId++
+	b.queue = b.queue[1:]
+	b.history = append(b.history, shout)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+	b.onAir = &shout
+	b.waiting = make(map[int]bool)
+	b.played = false
+	for client, ch := range b.clients {
+		select {
+		case ch <- shout:
+			b.waiting[client] = true
+		default:
+			// Too far behind; it will reconnect and replay from history.
+			b.drop(client)
+		}
+	}
+	time.AfterFunc(b.ch.Shouts.AckTimeout.Duration, func() {
+		b.Lock()
+		defer b.Unlock()
+		b.finish(shout.Id)
+	})
+	if len(b.waiting) == 0 {
+		b.finish(shout.Id)
+	}
+}
+
+// finish takes shout id off air and releases the next one. The caller
+// must hold the lock.
+func (b *shoutBroker) finish(id int) {
+	if b.onAir == nil || b.onAir.Id != id {
+		return
+	}
+	b.onAir = nil
+	b.waiting = nil
+	b.release()
+}
+
+// ack notes that client has finished playing shout id. The first ack is
+// when the shout counts as displayed in the history.
+func (b *shoutBroker) ack(client, id int) {
+	b.Lock()
+	defer b.Unlock()
+	if b.onAir == nil || b.onAir.Id != id || !b.waiting[client] {
+		return
+	}
+	if !b.played {
+		b.played = true
+		go b.ch.shoutDisplayed(b.onAir.RecordId)
+	}
+	delete(b.waiting, client)
+	if len(b.waiting) == 0 {
+		b.finish(id)
+	}
+}
+
+// subscribe registers an overlay. It returns the overlay's client id, a
+// channel of released shouts, and every kept shout after the given id.
+// An id of -1 means only new shouts. An id we have not issued yet must
+// come from before a restart, so everything is replayed.
+func (b *shoutBroker) subscribe(after int) (int, chan Shout, []Shout) {
+	b.Lock()
+	defer b.Unlock()
+	if after >= b.nextId {
+		after = 0
+	}
+	var backlog []Shout
+	if after >= 0 {
+		for _, s := range b.history {
+			if s.Id > after {
+				backlog = append(backlog, s)
+			}
+		}
+	}
+	b.nextClient++
+	ch := make(chan Shout, 16)
+	b.clients[b.nextClient] = ch
+	b.release()
+	return b.nextClient, ch, backlog
+}
+
+func (b *shoutBroker) unsubscribe(client int) {
+	b.Lock()
+	defer b.Unlock()
+	b.drop(client)
+}
+
+// drop forgets client, which no longer holds up the shout on air. The
+// caller must hold the lock.
+func (b *shoutBroker) drop(client int) {
+	ch, ok := b.clients[client]
+	if !ok {
+		return
+	}
+	delete(b.clients, client)
+	close(ch)
+	if b.onAir != nil && b.waiting[client] {
+		delete(b.waiting, client)
+		if len(b.waiting) == 0 {
+			b.finish(b.onAir.Id)
+		}
+	}
+}
+
+func (b *shoutBroker) get(id int) (Shout, bool) {
+	b.Lock()
+	defer b.Unlock()
+	for _, s := range b.history {
+		if s.Id == id {
+			return s, true
+		}
+	}
+	return Shout{}, false
+}
+
+func shouts(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Query("id"))
+	if err != nil {
+		ctx.Status(200)
+		return
+	}
+	s, ok := channelOf(ctx).shouts.get(id)
+	if !ok {
+		ctx.Status(200)
+		return
+	}
+	ctx.HTML(200, "shouts.tmpl", gin.H{"Shout": s})
+}
+
+// shoutAck is called by an overlay once it has finished playing a shout.
+func shoutAck(ctx *gin.Context) {
+	client, err := strconv.Atoi(ctx.Query("client"))
+	if err != nil {
+		ctx.Status(400)
+		return
+	}
+	id, err := strconv.Atoi(ctx.Query("id"))
+	if err != nil {
+		ctx.Status(400)
+		return
+	}
+	channelOf(ctx).shouts.ack(client, id)
+	ctx.Status(200)
+}
+
+// shoutStream pushes shouts to an overlay as Server-Sent Events. The
+// overlay resumes with the Last-Event-ID header its EventSource sends on
+// reconnect, or ?last= after a page reload.
+func shoutStream(ctx *gin.Context) {
+	last := ctx.Request.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = ctx.Query("last")
+	}
+	after, err := strconv.Atoi(last)
+	if err != nil {
+		after = -1
+	}
+	feed := channelOf(ctx).shouts
+	client, released, backlog := feed.subscribe(after)
+	defer feed.unsubscribe(client)
+
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.SSEvent("hello", client)
+	for _, s := range backlog {
+		ctx.Render(-1, shoutEvent(s))
+	}
+	ctx.Writer.Flush()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	done := ctx.Request.Context().Done()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case s, ok := <-released:
+			if !ok {
+				return false
+			}
+			ctx.Render(-1, shoutEvent(s))
+			return true
+		case <-ping.C:
+			ctx.SSEvent("ping", "")
+			return true
+		case <-done:
+			return false
+		}
+	})
+}
+
+func shoutEvent(s Shout) sse.Event {
+	return sse.Event{Event: "shout", Id: strconv.Itoa(s.Id), Retry: 3000, Data: s}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const stonesParam string = "stones"
+
+// StoneConfig is the magic stone economy. Users earn stones by being
+// around and spend them on rolls.
+type StoneConfig struct {
+	// RollCost is what every egg costs. Zero makes rolls free.
+	RollCost int `json:"roll_cost"`
+	// ActiveGrant stones go to everyone who used a command within the
+	// last ActiveWindow, once every ActiveWindow. Zero turns it off.
+	ActiveGrant  int      `json:"active_grant"`
+	ActiveWindow Duration `json:"active_window"`
+	// DailyGrant stones come with a user's first command of each day, in
+	// UTC.
+	DailyGrant int `json:"daily_grant"`
+}
+
+func validateStones(c StoneConfig) error {
+	if c.RollCost < 0 || c.ActiveGrant < 0 || c.DailyGrant < 0 {
+		return errors.New("stone costs and grants cannot be negative")
+	}
+	if c.ActiveGrant > 0 && c.ActiveWindow.Duration < time.Second {
+		return errors.New("stone active window must be at least 1s")
+	}
+	return nil
+}
+
+func notEnoughStones(user string, count int, balance int) string {
+	cost := count * config.Stones.RollCost
+	if count == 1 {
+		return fmt.Sprintf("%s needs %d stones to roll but only has %d.", user, cost, balance)
+	}
+	return fmt.Sprintf("%s needs %d stones for %d rolls but only has %d.", user, cost, count, balance)
+}
+
+// visit notes that user used a command and hands out their daily stones
+// if they have not had them today. It returns what to tell them about it.
+func (ch *Channel) visit(user string, now time.Time) string {
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return ""
+	}
+	userInfo.Box.Lock()
+	defer userInfo.Box.Unlock()
+	userInfo.LastActive = now
+	day := now.UTC().Format("2006-01-02")
+	if config.Stones.DailyGrant == 0 || userInfo.LastDaily == day {
+		return ""
+	}
+	balance, claimed, err := ch.store.ClaimDaily(user, day, config.Stones.DailyGrant)
+	if err != nil {
+		log.Printf("stones: daily stones for %s on %s: %v", user, ch.Name, err)
+		return ""
+	}
+	userInfo.LastDaily = day
+	if !claimed {
+		return ""
+	}
+	userInfo.Stones = balance
+	return fmt.Sprintf("%s got %d stones for dropping by today.", user, config.Stones.DailyGrant)
+}
+
+// grantActiveStones pays ActiveGrant, every window, to the users of every
+// channel who used a command during it.
+func grantActiveStones(window time.Duration) {
+	for now := range time.Tick(window) {
+		for _, ch := range channels {
+			ch.grantActive(now.Add(-window))
+		}
+	}
+}
+
+func (ch *Channel) grantActive(since time.Time) {
+	var active []*User
+	ch.users.RLock()
+	for _, userInfo := range ch.users.m {
+		userInfo.Box.RLock()
+		if userInfo.LastActive.After(since) {
+			active = append(active, userInfo)
+		}
+		userInfo.Box.RUnlock()
+	}
+	ch.users.RUnlock()
+	for _, userInfo := range active {
+		userInfo.Box.Lock()
+		balance, err := ch.store.AddStones(userInfo.Name, config.Stones.ActiveGrant)
+		if err != nil {
+			log.Printf("stones: active stones for %s on %s: %v", userInfo.Name, ch.Name, err)
+		} else {
+			userInfo.Stones = balance
+		}
+		userInfo.Box.Unlock()
+	}
+	if len(active) > 0 {
+		log.Printf("stones: gave %d stones to %d active users on %s", config.Stones.ActiveGrant, len(active), ch.Name)
+	}
+}
+
+var errNotScammed = errors.New("not scammed yet")
+
+// giveStones adds stones to user's balance and returns what they have now.
+func (ch *Channel) giveStones(user string, stones int) (int, error) {
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return 0, errNotScammed
+	}
+	userInfo.Box.Lock()
+	defer userInfo.Box.Unlock()
+	balance, err := ch.store.AddStones(user, stones)
+	if err != nil {
+		log.Printf("stones: granting %d to %s on %s: %v", stones, user, ch.Name, err)
+		return 0, err
+	}
+	userInfo.Stones = balance
+	log.Printf("stones: granted %d to %s on %s", stones, user, ch.Name)
+	return balance, nil
+}
+
+// grantStones is the admin route giving ?stones= to ?user=.
+func grantStones(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	user := ctx.Query(userParam)
+	stones, err := strconv.Atoi(ctx.Query(stonesParam))
+	if err != nil || stones < 1 {
+		ctx.JSON(400, gin.H{"error": "stones must be a positive number."})
+		return
+	}
+	balance, err := ch.giveStones(user, stones)
+	if err == errNotScammed {
+		ctx.JSON(404, gin.H{"error": user + " has not been scammed yet."})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(200, gin.H{"user": user, "stones": balance})
+}
+
+// grant is the chat version of grantStones, for moderators.
+func grant(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
+	}
+	stones, err := strconv.Atoi(args.Get(stonesParam))
+	if err != nil || stones < 1 {
+		return "stones must be a positive number."
+	}
+	balance, err := ch.giveStones(user, stones)
+	if err == errNotScammed {
+		return user + " has not been scammed yet."
+	}
+	if err != nil {
+		return "Something went wrong, " + user + " got no stones."
+	}
+	return fmt.Sprintf("%s got %d stones and now has %d.", user, stones, balance)
+}
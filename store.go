@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store persists the users and boxes of one channel, and its shouts.
+// Handlers update the in-memory users map only after the Store call
+// succeeds.
+type Store interface {
+	// LoadUsers returns every user with their box, leader first.
+	LoadUsers() ([]*User, error)
+	// CreateUser adds a user owning a single starter card as leader.
+	CreateUser(name string, starterId int) (UserCard, error)
+	// KeepCard adds a card with id to user's box and makes it the leader.
+	// roll is the roll it came from, which is marked kept.
+	KeepCard(user string, id int, roll int) (UserCard, error)
+	SetLeader(user string, card UserCard) error
+	ReleaseCard(user string, card UserCard) error
+	// SaveRoll records rolls, filling in their ids, stores user's pity
+	// after them and takes cost stones, returning their new balance. It
+	// fails with errNotEnoughStones, changing nothing, if they cannot
+	// afford it.
+	SaveRoll(user string, pity int, cost int, rolls []RollRecord) (int, error)
+	// AddStones credits user and returns their new balance.
+	AddStones(user string, stones int) (int, error)
+	// ClaimDaily credits user stones unless they already claimed them on
+	// day, a date like "2026-01-02". It returns their balance and whether
+	// they were credited.
+	ClaimDaily(user string, day string, stones int) (int, bool, error)
+	// SellCard removes card from user's box and credits them points. It
+	// returns their new balance.
+	SellCard(user string, card UserCard, points int) (int, error)
+	// AddMonsterPoints credits user and returns their new balance.
+	AddMonsterPoints(user string, points int) (int, error)
+	// BuyCard takes price from user and adds a card with id to the end of
+	// their box, returning it and their new balance. It fails with
+	// errNotEnoughPoints, changing nothing, if they cannot afford it.
+	BuyCard(user string, id int, price int) (UserCard, int, error)
+
+	// RollHistory returns user's rolls newest first, and how many there
+	// are.
+	RollHistory(user string, offset int, limit int) ([]RollRecord, int, error)
+	// RollTiers counts user's rolls by tier name.
+	RollTiers(user string) (map[string]int, error)
+	// RollStats counts everyone's rolls on banner from since until until
+	// by tier name, leaving out the ones pity decided.
+	RollStats(banner string, since time.Time, until time.Time) (map[string]int, error)
+
+	// RecordShout adds a shout to the history and returns its id.
+	RecordShout(rec ShoutRecord) (int, error)
+	UpdateShout(id int, outcome string, message string, reason string) error
+	ShoutDisplayed(id int, at time.Time) error
+	// ShoutHistory returns shouts newest first, and how many there are.
+	ShoutHistory(offset int, limit int) ([]ShoutRecord, int, error)
+	GetShout(id int) (ShoutRecord, error)
+}
+
+var errNotEnoughPoints = errors.New("not enough monster points")
+var errNotEnoughStones = errors.New("not enough stones")
+
+// openStore connects to the kind of storage configured and returns a
+// function giving each channel its own Store within it.
+func openStore(kind string) func(channel string) Store {
+	switch kind {
+	case "postgres":
+		db := openDB()
+		err := migrateDB(db, config.MigrateOnStart)
+		if err != nil {
+			panic(err)
+		}
+		if err = checkChannels(db, config.Channels); err != nil {
+			panic(err)
+		}
+		return func(channel string) Store { return pgStore{db, channel} }
+	case "memory":
+		return func(channel string) Store { return newMemStore() }
+	}
+	panic(fmt.Sprintf("unknown storage %q", kind))
+}
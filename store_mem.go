@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// memStore keeps everything in process memory. It is meant for running
+// the bot locally and for tests; nothing survives a restart.
+type memStore struct {
+	sync.Mutex
+	users   map[string]*memUser
+	order   []string
+	nextKey int
+	rolls   []RollRecord
+	shouts  []ShoutRecord
+}
+
+type memUser struct {
+	leader int
+	pity   int
+	points int
+	stones int
+	daily  string
+	cards  []UserCard
+}
+
+func newMemStore() *memStore {
+	return &memStore{users: make(map[string]*memUser), nextKey: 1}
+}
+
+func (s *memStore) user(name string) (*memUser, error) {
+	u, ok := s.users[name]
+	if !ok {
+		return nil, fmt.Errorf("no user %q", name)
+	}
+	return u, nil
+}
+
+func (s *memStore) newCard(id int) UserCard {
+	card := UserCard{Key: s.nextKey, Id: id}
+	s.nextKey++
+	return card
+}
+
+func (s *memStore) LoadUsers() ([]*User, error) {
+	s.Lock()
+	defer s.Unlock()
+	var ret []*User
+	for _, name := range s.order {
+		u := s.users[name]
+		cards := []UserCard{}
+		for _, card := range u.cards {
+			if card.Key == u.leader {
+				cards = append([]UserCard{card}, cards...)
+			} else {
+				cards = append(cards, card)
+			}
+		}
+		ret = append(ret, &User{Name: name, Box: Box{UserCards: cards}, Pity: u.pity, MonsterPoints: u.points, Stones: u.stones, LastDaily: u.daily})
+	}
+	return ret, nil
+}
+
+func (s *memStore) CreateUser(name string, starterId int) (UserCard, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, exists := s.users[name]; exists {
+		return UserCard{}, fmt.Errorf("user %q already exists", name)
+	}
+	card := s.newCard(starterId)
+	s.users[name] = &memUser{leader: card.Key, cards: []UserCard{card}}
+	s.order = append(s.order, name)
+	return card, nil
+}
+
+func (s *memStore) KeepCard(user string, id int, roll int) (UserCard, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return UserCard{}, err
+	}
+	if roll > 0 && roll <= len(s.rolls) && s.rolls[roll-1].Name == user {
+		s.rolls[roll-1].Kept = true
+	}
+	card := s.newCard(id)
+	u.cards = append(u.cards, card)
+	u.leader = card.Key
+	return card, nil
+}
+
+func (s *memStore) SetLeader(user string, card UserCard) error {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return err
+	}
+	u.leader = card.Key
+	return nil
+}
+
+func (s *memStore) ReleaseCard(user string, card UserCard) error {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return err
+	}
+	return u.remove(user, card)
+}
+
+func (u *memUser) remove(user string, card UserCard) error {
+	for i, c := range u.cards {
+		if c.Key == card.Key {
+			u.cards = append(u.cards[:i], u.cards[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not own card %d", user, card.Key)
+}
+
+func (s *memStore) SaveRoll(user string, pity int, cost int, rolls []RollRecord) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return 0, err
+	}
+	if u.stones < cost {
+		return 0, errNotEnoughStones
+	}
+	u.pity = pity
+	u.stones -= cost
+	for i := range rolls {
+		rolls[i].Id = len(s.rolls) + 1
+		rolls[i].Name = user
+		s.rolls = append(s.rolls, rolls[i])
+	}
+	return u.stones, nil
+}
+
+func (s *memStore) AddStones(user string, stones int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return 0, err
+	}
+	u.stones += stones
+	return u.stones, nil
+}
+
+func (s *memStore) ClaimDaily(user string, day string, stones int) (int, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return 0, false, err
+	}
+	if u.daily == day {
+		return u.stones, false, nil
+	}
+	u.daily = day
+	u.stones += stones
+	return u.stones, true, nil
+}
+
+func (s *memStore) SellCard(user string, card UserCard, points int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return 0, err
+	}
+	if err = u.remove(user, card); err != nil {
+		return 0, err
+	}
+	u.points += points
+	return u.points, nil
+}
+
+func (s *memStore) AddMonsterPoints(user string, points int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return 0, err
+	}
+	u.points += points
+	return u.points, nil
+}
+
+func (s *memStore) BuyCard(user string, id int, price int) (UserCard, int, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.user(user)
+	if err != nil {
+		return UserCard{}, 0, err
+	}
+	if u.points < price {
+		return UserCard{}, 0, errNotEnoughPoints
+	}
+	u.points -= price
+	card := s.newCard(id)
+	u.cards = append(u.cards, card)
+	return card, u.points, nil
+}
+
+func (s *memStore) RollHistory(user string, offset int, limit int) ([]RollRecord, int, error) {
+	s.Lock()
+	defer s.Unlock()
+	var ret []RollRecord
+	total := 0
+	for i := len(s.rolls) - 1; i >= 0; i-- {
+		if s.rolls[i].Name != user {
+			continue
+		}
+		if total >= offset && len(ret) < limit {
+			ret = append(ret, s.rolls[i])
+		}
+		total++
+	}
+	return ret, total, nil
+}
+
+func (s *memStore) RollTiers(user string) (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := make(map[string]int)
+	for _, r := range s.rolls {
+		if r.Name == user {
+			ret[r.Tier]++
+		}
+	}
+	return ret, nil
+}
+
+func (s *memStore) RollStats(banner string, since time.Time, until time.Time) (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := make(map[string]int)
+	for _, r := range s.rolls {
+		if r.Banner == banner && !r.Pity && !r.Rolled.Before(since) && r.Rolled.Before(until) {
+			ret[r.Tier]++
+		}
+	}
+	return ret, nil
+}
+
+func (s *memStore) shout(id int) (*ShoutRecord, error) {
+	if id < 1 || id > len(s.shouts) {
+		return nil, fmt.Errorf("no shout %d", id)
+	}
+	return &s.shouts[id-1], nil
+}
+
+func (s *memStore) RecordShout(rec ShoutRecord) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	rec.Id = len(s.shouts) + 1
+	s.shouts = append(s.shouts, rec)
+	return rec.Id, nil
+}
+
+func (s *memStore) UpdateShout(id int, outcome string, message string, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+	rec, err := s.shout(id)
+	if err != nil {
+		return err
+	}
+	rec.Outcome, rec.Message, rec.Reason = outcome, message, reason
+	return nil
+}
+
+func (s *memStore) ShoutDisplayed(id int, at time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	rec, err := s.shout(id)
+	if err != nil {
+		return err
+	}
+	rec.Displayed = &at
+	return nil
+}
+
+func (s *memStore) ShoutHistory(offset int, limit int) ([]ShoutRecord, int, error) {
+	s.Lock()
+	defer s.Unlock()
+	var ret []ShoutRecord
+	for i := len(s.shouts) - 1 - offset; i >= 0 && len(ret) < limit; i-- {
+		ret = append(ret, s.shouts[i])
+	}
+	return ret, len(s.shouts), nil
+}
+
+func (s *memStore) GetShout(id int) (ShoutRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+	rec, err := s.shout(id)
+	if err != nil {
+		return ShoutRecord{}, err
+	}
+	return *rec, nil
+}
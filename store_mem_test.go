@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestChannel resets the config, loads a small catalog and returns a
+// channel backed by store. Rolls are free and pity is off.
+func newTestChannel(t *testing.T, store Store) *Channel {
+	config = defaultConfig()
+	config.Tiers = defaultTiers()
+	config.BoxSize = 4
+	config.Pity.Threshold = 0
+	config.Stones = StoneConfig{}
+	c, err := newCatalog([]Card{
+		{Id: 1, Name: "Starter", Rarity: 1},
+		{Id: 2, Name: "Tamadra", Rarity: 2},
+		{Id: 3, Name: "Pengdra", Rarity: 3},
+		{Id: 4, Name: "Ra", Rarity: 7, Monster_points: 5000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog.Lock()
+	catalog.c = c
+	catalog.Unlock()
+	return newChannel(ChannelConfig{
+		Name:     "test",
+		Streamer: "Tester",
+		Support:  config.Support,
+		Shouts:   config.Shouts,
+	}, store)
+}
+
+func userArgs(user string, kv ...string) url.Values {
+	args := url.Values{userParam: {user}}
+	for i := 0; i+1 < len(kv); i += 2 {
+		args.Set(kv[i], kv[i+1])
+	}
+	return args
+}
+
+func boxOf(t *testing.T, ch *Channel, user string) *User {
+	ch.users.RLock()
+	defer ch.users.RUnlock()
+	userInfo, ok := ch.users.m[user]
+	if !ok {
+		t.Fatalf("%s is not in the users map", user)
+	}
+	return userInfo
+}
+
+func TestScamRollKeepRelease(t *testing.T) {
+	store := newMemStore()
+	ch := newTestChannel(t, store)
+
+	if got := scam(ch, userArgs("mia")); got != "mia has been successfully scammed." {
+		t.Fatalf("scam: %q", got)
+	}
+	if got := scam(ch, userArgs("mia")); got != "mia has already been scammed." {
+		t.Fatalf("second scam: %q", got)
+	}
+	mia := boxOf(t, ch, "mia")
+	if len(mia.Box.UserCards) != 1 || mia.Box.UserCards[0].Id != 1 {
+		t.Fatalf("box after scam: %v", mia.Box.UserCards)
+	}
+
+	if got := roll(ch, userArgs("mia", countParam, "3")); !strings.HasPrefix(got, "mia's 3 rolls: ") {
+		t.Fatalf("roll: %q", got)
+	}
+	if len(mia.Box.Pending) != 3 {
+		t.Fatalf("pending after roll: %v", mia.Box.Pending)
+	}
+	rolled := append([]PendingCard(nil), mia.Box.Pending...)
+	for _, p := range rolled {
+		if p.Roll == 0 {
+			t.Errorf("pending card %v has no roll record", p)
+		}
+	}
+
+	if got := keep(ch, userArgs("mia")); !strings.Contains(got, "pick one to keep") {
+		t.Fatalf("keep without a card: %q", got)
+	}
+	keep(ch, userArgs("mia", cardParam, "2"))
+	if mia.Box.UserCards[0].Id != rolled[1].Id || len(mia.Box.UserCards) != 2 {
+		t.Fatalf("box after keeping card 2: %v", mia.Box.UserCards)
+	}
+	if !reflect.DeepEqual(mia.Box.Pending, []PendingCard{rolled[0], rolled[2]}) {
+		t.Fatalf("pending after keeping card 2: %v", mia.Box.Pending)
+	}
+	keep(ch, userArgs("mia", cardParam, "1"))
+	if mia.Box.UserCards[0].Id != rolled[0].Id || mia.Box.UserCards[1].Id != rolled[1].Id || mia.Box.UserCards[2].Id != 1 {
+		t.Fatalf("box after keeping card 1: %v", mia.Box.UserCards)
+	}
+
+	if got := release(ch, userArgs("mia", cardParam, "1")); got != "mia cannot release their leader." {
+		t.Fatalf("release leader: %q", got)
+	}
+	if got := release(ch, userArgs("mia", cardParam, "3")); got != "mia released Starter." {
+		t.Fatalf("release: %q", got)
+	}
+
+	loaded, err := store.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || !reflect.DeepEqual(loaded[0].Box.UserCards, mia.Box.UserCards) {
+		t.Fatalf("stored box %v, users map has %v", loaded[0].Box.UserCards, mia.Box.UserCards)
+	}
+	history, total, err := store.RollHistory("mia", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for _, r := range history {
+		if r.Kept {
+			kept++
+		}
+	}
+	if total != 3 || kept != 2 {
+		t.Fatalf("roll history has %d rolls, %d kept", total, kept)
+	}
+}
+
+var errBroken = errors.New("broken")
+
+// brokenStore fails every write that the commands below make.
+type brokenStore struct {
+	Store
+}
+
+func (brokenStore) CreateUser(string, int) (UserCard, error) { return UserCard{}, errBroken }
+func (brokenStore) KeepCard(string, int, int) (UserCard, error) {
+	return UserCard{}, errBroken
+}
+func (brokenStore) ReleaseCard(string, UserCard) error { return errBroken }
+func (brokenStore) SaveRoll(string, int, int, []RollRecord) (int, error) {
+	return 0, errBroken
+}
+
+func TestFailedStoreLeavesUsersAlone(t *testing.T) {
+	store := newMemStore()
+	ch := newTestChannel(t, store)
+	scam(ch, userArgs("mia"))
+	roll(ch, userArgs("mia", countParam, "2"))
+	keep(ch, userArgs("mia", cardParam, "1"))
+	roll(ch, userArgs("mia", countParam, "2"))
+
+	mia := boxOf(t, ch, "mia")
+	cards := append([]UserCard(nil), mia.Box.UserCards...)
+	pending := append([]PendingCard(nil), mia.Box.Pending...)
+	pity := mia.Pity
+
+	ch.store = brokenStore{store}
+	failed := "Something went wrong, mia's box was not changed."
+	for name, got := range map[string]string{
+		"roll":    roll(ch, userArgs("mia")),
+		"keep":    keep(ch, userArgs("mia", cardParam, "1")),
+		"release": release(ch, userArgs("mia", cardParam, "2")),
+	} {
+		if got != failed {
+			t.Errorf("%s: %q", name, got)
+		}
+	}
+	if got := scam(ch, userArgs("leo")); got != "Something went wrong, leo's box was not changed." {
+		t.Errorf("scam: %q", got)
+	}
+
+	if !reflect.DeepEqual(mia.Box.UserCards, cards) {
+		t.Errorf("box changed to %v from %v", mia.Box.UserCards, cards)
+	}
+	if !reflect.DeepEqual(mia.Box.Pending, pending) {
+		t.Errorf("pending changed to %v from %v", mia.Box.Pending, pending)
+	}
+	if mia.Pity != pity {
+		t.Errorf("pity changed to %d from %d", mia.Pity, pity)
+	}
+	ch.users.RLock()
+	_, leoExists := ch.users.m["leo"]
+	ch.users.RUnlock()
+	if leoExists {
+		t.Error("leo was added to the users map")
+	}
+}
+
+func TestMemStoreDailyClaim(t *testing.T) {
+	store := newMemStore()
+	if _, err := store.CreateUser("mia", 1); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Format("2006-01-02")
+	if balance, claimed, _ := store.ClaimDaily("mia", day, 10); !claimed || balance != 10 {
+		t.Fatalf("first claim: %d %v", balance, claimed)
+	}
+	if balance, claimed, _ := store.ClaimDaily("mia", day, 10); claimed || balance != 10 {
+		t.Fatalf("second claim: %d %v", balance, claimed)
+	}
+	if _, err := store.SaveRoll("mia", 0, 11, nil); err != errNotEnoughStones {
+		t.Fatalf("overspending: %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// SQL
+const selectUsers string = `
+	SELECT name, cards, pity, monster_points, stones, COALESCE(to_char(last_daily, 'YYYY-MM-DD'), '')
+	FROM Users WHERE channel = $1`
+const selectUserCards string = `SELECT key, id, owner FROM UserCards WHERE channel = $1 AND owner IS NOT NULL ORDER BY key`
+const insertUserCard string = `INSERT INTO UserCards (channel, id, owner) VALUES ($1, $2, $3) RETURNING key`
+const deleteUserCard string = `DELETE FROM UserCards Where channel = $1 AND key = $2 AND owner = $3`
+const insertUser string = `INSERT INTO Users (channel, name, cards) VALUES ($1, $2, $3)`
+const updateUser string = `UPDATE Users SET cards = $1 WHERE channel = $2 AND name = $3`
+const addUserPoints string = `
+	UPDATE Users SET monster_points = monster_points + $1
+	WHERE channel = $2 AND name = $3 RETURNING monster_points`
+const spendUserPoints string = `
+	UPDATE Users SET monster_points = monster_points - $1
+	WHERE channel = $2 AND name = $3 AND monster_points >= $1 RETURNING monster_points`
+const updateUserRoll string = `
+	UPDATE Users SET pity = $1, stones = stones - $2
+	WHERE channel = $3 AND name = $4 AND stones >= $2 RETURNING stones`
+const addUserStones string = `
+	UPDATE Users SET stones = stones + $1
+	WHERE channel = $2 AND name = $3 RETURNING stones`
+const claimUserDaily string = `
+	UPDATE Users SET stones = stones + $1, last_daily = $2
+	WHERE channel = $3 AND name = $4 AND last_daily IS DISTINCT FROM $2 RETURNING stones`
+const insertRoll string = `
+	INSERT INTO Rolls (channel, name, card, tier, banner, pity, rolled_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+const updateRollKept string = `UPDATE Rolls SET kept = true WHERE channel = $1 AND name = $2 AND id = $3`
+const selectRolls string = `
+	SELECT id, name, card, tier, banner, pity, rolled_at, kept
+	FROM Rolls WHERE channel = $1 AND name = $2`
+const countRolls string = `SELECT COUNT(*) FROM Rolls WHERE channel = $1 AND name = $2`
+const countRollTiers string = `SELECT tier, COUNT(*) FROM Rolls WHERE channel = $1 AND name = $2 GROUP BY tier`
+const countBannerTiers string = `
+	SELECT tier, COUNT(*) FROM Rolls
+	WHERE channel = $1 AND banner = $2 AND NOT pity AND rolled_at >= $3 AND rolled_at < $4
+	GROUP BY tier`
+const insertShout string = `
+	INSERT INTO Shouts (channel, name, leader, message, outcome, reason, replay_of, received_at)
+	VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), $8) RETURNING id`
+const updateShoutOutcome string = `UPDATE Shouts SET outcome = $3, message = $4, reason = $5 WHERE channel = $1 AND id = $2`
+const updateShoutDisplayed string = `UPDATE Shouts SET displayed_at = $3 WHERE channel = $1 AND id = $2`
+const selectShouts string = `
+	SELECT id, name, leader, message, outcome, reason, COALESCE(replay_of, 0), received_at, displayed_at
+	FROM Shouts WHERE channel = $1`
+const countShouts string = `SELECT COUNT(*) FROM Shouts WHERE channel = $1`
+
+// pgStore is one channel's view of the database.
+type pgStore struct {
+	db      *sql.DB
+	channel string
+}
+
+func openDB() *sql.DB {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL")+"?sslmode=disable")
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func (s pgStore) LoadUsers() ([]*User, error) {
+	rows, err := s.db.Query(selectUsers, s.channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*User
+	var byName = make(map[string]*User)
+	var leaders = make(map[string]int)
+	for rows.Next() {
+		var name string
+		var leaderKey, pity, points, stones int
+		var lastDaily string
+		err = rows.Scan(&name, &leaderKey, &pity, &points, &stones, &lastDaily)
+		if err != nil {
+			return nil, err
+		}
+		user := &User{Name: name, Box: Box{UserCards: []UserCard{}}, Pity: pity, MonsterPoints: points, Stones: stones, LastDaily: lastDaily}
+		ret = append(ret, user)
+		byName[name] = user
+		leaders[name] = leaderKey
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.Query(selectUserCards, s.channel)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var userCard UserCard
+		var owner string
+		err = res.Scan(&userCard.Key, &userCard.Id, &owner)
+		if err != nil {
+			return nil, err
+		}
+		user, ok := byName[owner]
+		if !ok {
+			continue
+		}
+		if userCard.Key == leaders[owner] {
+			user.Box.UserCards = append([]UserCard{userCard}, user.Box.UserCards...)
+		} else {
+			user.Box.UserCards = append(user.Box.UserCards, userCard)
+		}
+	}
+	return ret, res.Err()
+}
+
+// inTx runs f in a transaction that is committed only if f succeeds.
+func (s pgStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// setLeader points user at the card with key, failing if there is no
+// such user so the surrounding transaction rolls back.
+func (s pgStore) setLeader(tx *sql.Tx, user string, key int) error {
+	res, err := tx.Exec(updateUser, key, s.channel, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("no user %q", user)
+	}
+	return nil
+}
+
+func (s pgStore) CreateUser(name string, starterId int) (UserCard, error) {
+	var key int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(insertUserCard, s.channel, starterId, name).Scan(&key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(insertUser, s.channel, name, key)
+		return err
+	})
+	if err != nil {
+		return UserCard{}, err
+	}
+	return UserCard{Key: key, Id: starterId}, nil
+}
+
+func (s pgStore) KeepCard(user string, id int, roll int) (UserCard, error) {
+	var key int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(insertUserCard, s.channel, id, user).Scan(&key)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(updateRollKept, s.channel, user, roll); err != nil {
+			return err
+		}
+		return s.setLeader(tx, user, key)
+	})
+	if err != nil {
+		return UserCard{}, err
+	}
+	return UserCard{Key: key, Id: id}, nil
+}
+
+func (s pgStore) SetLeader(user string, card UserCard) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return s.setLeader(tx, user, card.Key)
+	})
+}
+
+func (s pgStore) ReleaseCard(user string, card UserCard) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return s.deleteCard(tx, user, card)
+	})
+}
+
+// deleteCard removes card from user's box, failing if they do not own it.
+func (s pgStore) deleteCard(tx *sql.Tx, user string, card UserCard) error {
+	res, err := tx.Exec(deleteUserCard, s.channel, card.Key, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("%s does not own card %d", user, card.Key)
+	}
+	return nil
+}
+
+func (s pgStore) SaveRoll(user string, pity int, cost int, rolls []RollRecord) (int, error) {
+	var balance int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(updateUserRoll, pity, cost, s.channel, user).Scan(&balance)
+		if err == sql.ErrNoRows {
+			return errNotEnoughStones
+		}
+		if err != nil {
+			return err
+		}
+		for i, r := range rolls {
+			err = tx.QueryRow(insertRoll, s.channel, user, r.Card, r.Tier, r.Banner, r.Pity, r.Rolled).Scan(&rolls[i].Id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return balance, err
+}
+
+func (s pgStore) AddStones(user string, stones int) (int, error) {
+	var balance int
+	err := s.db.QueryRow(addUserStones, stones, s.channel, user).Scan(&balance)
+	return balance, err
+}
+
+func (s pgStore) ClaimDaily(user string, day string, stones int) (int, bool, error) {
+	var balance int
+	err := s.db.QueryRow(claimUserDaily, stones, day, s.channel, user).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return balance, err == nil, err
+}
+
+func (s pgStore) SellCard(user string, card UserCard, points int) (int, error) {
+	var balance int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := s.deleteCard(tx, user, card)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(addUserPoints, points, s.channel, user).Scan(&balance)
+	})
+	return balance, err
+}
+
+func (s pgStore) AddMonsterPoints(user string, points int) (int, error) {
+	var balance int
+	err := s.db.QueryRow(addUserPoints, points, s.channel, user).Scan(&balance)
+	return balance, err
+}
+
+func (s pgStore) BuyCard(user string, id int, price int) (UserCard, int, error) {
+	var key, balance int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(spendUserPoints, price, s.channel, user).Scan(&balance)
+		if err == sql.ErrNoRows {
+			return errNotEnoughPoints
+		}
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(insertUserCard, s.channel, id, user).Scan(&key)
+	})
+	if err != nil {
+		return UserCard{}, 0, err
+	}
+	return UserCard{Key: key, Id: id}, balance, nil
+}
+
+func (s pgStore) RollHistory(user string, offset int, limit int) ([]RollRecord, int, error) {
+	var total int
+	err := s.db.QueryRow(countRolls, s.channel, user).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query(selectRolls+` ORDER BY id DESC LIMIT $3 OFFSET $4`, s.channel, user, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var ret []RollRecord
+	for rows.Next() {
+		var r RollRecord
+		err = rows.Scan(&r.Id, &r.Name, &r.Card, &r.Tier, &r.Banner, &r.Pity, &r.Rolled, &r.Kept)
+		if err != nil {
+			return nil, 0, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, total, rows.Err()
+}
+
+func (s pgStore) RollTiers(user string) (map[string]int, error) {
+	rows, err := s.db.Query(countRollTiers, s.channel, user)
+	if err != nil {
+		return nil, err
+	}
+	return scanTierCounts(rows)
+}
+
+func (s pgStore) RollStats(banner string, since time.Time, until time.Time) (map[string]int, error) {
+	rows, err := s.db.Query(countBannerTiers, s.channel, banner, since, until)
+	if err != nil {
+		return nil, err
+	}
+	return scanTierCounts(rows)
+}
+
+func scanTierCounts(rows *sql.Rows) (map[string]int, error) {
+	defer rows.Close()
+	ret := make(map[string]int)
+	for rows.Next() {
+		var tier string
+		var n int
+		if err := rows.Scan(&tier, &n); err != nil {
+			return nil, err
+		}
+		ret[tier] = n
+	}
+	return ret, rows.Err()
+}
+
+func (s pgStore) RecordShout(rec ShoutRecord) (int, error) {
+	var id int
+	err := s.db.QueryRow(insertShout, s.channel, rec.Name, rec.Leader, rec.Message, rec.Outcome, rec.Reason, rec.ReplayOf, rec.Received).Scan(&id)
+	return id, err
+}
+
+func (s pgStore) UpdateShout(id int, outcome string, message string, reason string) error {
+	_, err := s.db.Exec(updateShoutOutcome, s.channel, id, outcome, message, reason)
+	return err
+}
+
+func (s pgStore) ShoutDisplayed(id int, at time.Time) error {
+	_, err := s.db.Exec(updateShoutDisplayed, s.channel, id, at)
+	return err
+}
+
+func scanShout(row interface {
+	Scan(...interface{}) error
+}) (ShoutRecord, error) {
+	var rec ShoutRecord
+	err := row.Scan(&rec.Id, &rec.Name, &rec.Leader, &rec.Message, &rec.Outcome, &rec.Reason, &rec.ReplayOf, &rec.Received, &rec.Displayed)
+	return rec, err
+}
+
+func (s pgStore) ShoutHistory(offset int, limit int) ([]ShoutRecord, int, error) {
+	var total int
+	err := s.db.QueryRow(countShouts, s.channel).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query(selectShouts+` ORDER BY id DESC LIMIT $2 OFFSET $3`, s.channel, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var ret []ShoutRecord
+	for rows.Next() {
+		rec, err := scanShout(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		ret = append(ret, rec)
+	}
+	return ret, total, rows.Err()
+}
+
+func (s pgStore) GetShout(id int) (ShoutRecord, error) {
+	return scanShout(s.db.QueryRow(selectShouts+` AND id = $2`, s.channel, id))
+}
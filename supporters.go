@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type SupporterUi struct {
+	Name   string
+	Leader UserCard
+}
+
+type Supporter struct {
+	User    *User
+	Expires time.Time
+}
+
+func (s Supporter) expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// remaining is the time s has left, rounded to the second.
+func (s Supporter) remaining(now time.Time) time.Duration {
+	return s.Expires.Sub(now).Round(time.Second)
+}
+
+func (s Supporter) toUi() SupporterUi {
+	return SupporterUi{s.User.Name, s.User.Box.leader()}
+}
+
+// expire removes supporters whose time is up and gives their slots to the
+// next users waiting. The caller must hold the write lock.
+func (ch *Channel) expire(now time.Time) {
+	for user, s := range ch.supporters.m {
+		if s.expired(now) {
+			delete(ch.supporters.m, user)
+		}
+	}
+	for len(ch.supporters.m) < ch.Support.Slots && len(ch.supporters.waiting) > 0 {
+		next := ch.supporters.waiting[0]
+		ch.supporters.waiting = ch.supporters.waiting[1:]
+		ch.supporters.m[next.Name] = &Supporter{next, now.Add(ch.Support.Duration.Duration)}
+		log.Printf("support: %s moved up from the waiting list on %s", next.Name, ch.Name)
+	}
+}
+
+// waitingPlace returns user's place in the waiting list, 1 being next, or
+// 0 if they are not in it. The caller must hold the lock.
+func (ch *Channel) waitingPlace(user *User) int {
+	for i, u := range ch.supporters.waiting {
+		if u == user {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func expireSupporters(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for _, ch := range channels {
+			ch.supporters.Lock()
+			ch.expire(now)
+			ch.supporters.Unlock()
+		}
+	}
+}
+
+// supports lists the current supporters. Ones that expired since the last
+// sweep are left out but not removed.
+func supports(ctx *gin.Context) {
+	ch := channelOf(ctx)
+	now := time.Now()
+	var u = make(map[string]SupporterUi)
+	ch.supporters.RLock()
+	for user, s := range ch.supporters.m {
+		if !s.expired(now) {
+			u[user] = s.toUi()
+		}
+	}
+	ch.supporters.RUnlock()
+	ctx.HTML(200, "supports.tmpl", gin.H{"Supports": u})
+}
+
+func support(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
+	}
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return user + " has not been scammed yet."
+	}
+	now := time.Now()
+	ch.supporters.Lock()
+	defer ch.supporters.Unlock()
+	ch.expire(now)
+	if s, ok := ch.supporters.m[user]; ok {
+		return user + " is already supporting, " + s.remaining(now).String() + " left."
+	}
+	if place := ch.waitingPlace(userInfo); place > 0 {
+		return user + " is already #" + strconv.Itoa(place) + " in line to support."
+	}
+	if len(ch.supporters.m) >= ch.Support.Slots {
+		ch.supporters.waiting = append(ch.supporters.waiting, userInfo)
+		return ch.Streamer + " has too many supporters right now! " + user + " is #" + strconv.Itoa(len(ch.supporters.waiting)) + " in line."
+	}
+	s := &Supporter{userInfo, now.Add(ch.Support.Duration.Duration)}
+	ch.supporters.m[user] = s
+	return user + " is now supporting " + ch.Streamer + " with " + currentCatalog().Cards[userInfo.Box.leader().Id].Name + " for " + s.remaining(now).String() + "!"
+}
+
+// unsupport takes user off the overlay, or out of the waiting list.
+func unsupport(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
+	}
+	now := time.Now()
+	ch.supporters.Lock()
+	defer ch.supporters.Unlock()
+	ch.expire(now)
+	if _, ok := ch.supporters.m[user]; ok {
+		delete(ch.supporters.m, user)
+		ch.expire(now)
+		return user + " is no longer supporting " + ch.Streamer + "."
+	}
+	for i, u := range ch.supporters.waiting {
+		if u.Name == user {
+			ch.supporters.waiting = append(ch.supporters.waiting[:i], ch.supporters.waiting[i+1:]...)
+			return user + " left the line to support."
+		}
+	}
+	return user + " is not supporting."
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
+	"crypto/subtle"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
+	"log"
 	"math/rand"
-	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
@@ -15,11 +15,11 @@ import (
 )
 
 type Card struct {
-	Id             int    `json: id`
-	Name           string `json: name`
-	Rarity         int    `json: rarity`
-	Monster_points int    `json: monster_points`
-	Jp_only        bool   `json: jp_only`
+	Id             int    `json:"id"`
+	Name           string `json:"name"`
+	Rarity         int    `json:"rarity"`
+	Monster_points int    `json:"monster_points"`
+	Jp_only        bool   `json:"jp_only"`
 }
 
 type UserCard struct {
@@ -27,15 +27,48 @@ type UserCard struct {
 	Id  int
 }
 
+// Box is everything a user owns, leader first, plus the cards from their
+// last roll that have not been kept yet.
 type Box struct {
 	sync.RWMutex
-	UserCards *[]UserCard
+	UserCards []UserCard
+	Pending   []PendingCard
 	Size      int
 }
 
+// PendingCard is a card from a roll that has not been kept. Roll is the id
+// of its roll record.
+type PendingCard struct {
+	Id   int
+	Roll int
+}
+
+func (b *Box) leader() UserCard {
+	b.RLock()
+	defer b.RUnlock()
+	if len(b.UserCards) == 0 {
+		return UserCard{}
+	}
+	return b.UserCards[0]
+}
+
+func (b *Box) full() bool {
+	return len(b.UserCards) >= b.Size
+}
+
 type User struct {
 	Name string
 	Box  Box
+	// Pity counts rolls since the last egg of the pity tier or better.
+	// MonsterPoints is what the user can spend in the shop, and Stones
+	// what they spend on rolls. LastDaily is the day they last got their
+	// daily stones and LastActive when they last used a command. All of
+	// them are guarded by Box's lock.
+	Pity          int
+	MonsterPoints int
+	Stones        int
+	LastDaily     string
+	LastActive    time.Time
 }
 
 type ShouterUi struct {
@@ -44,404 +77,446 @@ type ShouterUi struct {
 	Message string
 }
 
-type SupporterUi struct {
-	Name   string
-	Leader UserCard
-}
-
-type Supporter struct {
-	User User
-	Ttl  int
-}
-
-func (s Supporter) expired() bool {
-	return s.Ttl <= 0
-}
-
-func (s *Supporter) tick() {
-	s.Ttl = s.Ttl - 1
-}
-
-func (s Supporter) toUi() SupporterUi {
-	return SupporterUi{s.User.Name, (*s.User.Box.UserCards)[0]}
-}
-
-// SQL
-const createUsers string = `
-	CREATE TABLE IF NOT EXISTS Users(
-		name TEXT PRIMARY KEY NOT NULL,
-		cards INT NOT NULL
-	)`
-const createUserCards string = `
-	CREATE TABLE IF NOT EXISTS UserCards(
-		key SERIAL PRIMARY KEY NOT NULL,
-		id INT NOT NULL
-	)`
-const selectUsers string = `SELECT * FROM Users`
-const insertUserCard string = `INSERT INTO UserCards (id) VALUES ($1) RETURNING key`
-const deleteUserCard string = `DELETE FROM UserCards Where key = $1`
-const insertUser string = `INSERT INTO Users (name, cards) VALUES ($1, $2)`
-const updateUser string = `UPDATE Users SET (cards) = ($1) WHERE name = $2`
-
 const userParam string = "user"
 const messageParam string = "message"
+const bannerParam string = "banner"
+const countParam string = "count"
+const cardParam string = "card"
+const pendingParam string = "new"
+const itemParam string = "item"
 
-var validIds []int = []int{}
-var cards map[int]Card = getCards()
-var users = struct {
-	sync.RWMutex
-	m map[string]User
-}{m: make(map[string]User)}
-
-var supporters = struct {
-	sync.RWMutex
-	m map[string]*Supporter
-}{m: make(map[string]*Supporter)}
-
-var shouters = make(chan ShouterUi, 100)
-
-var db *sql.DB
-
-func bootstrapDB() {
-	var err error
-	db, err = sql.Open("postgres", os.Getenv("DATABASE_URL")+"?sslmode=disable")
-	if err != nil {
-		panic(err)
-	}
+func main() {
+	rand.Seed(time.Now().Unix())
+	fmt.Println("Starting server")
 
-	_, err = db.Query(createUsers)
-	if err != nil {
-		panic(err)
+	config = loadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
 	}
-	_, err = db.Query(createUserCards)
-	if err != nil {
-		panic(err)
+	loadCatalog()
+	if config.Catalog.RefreshInterval.Duration > 0 {
+		go refreshCatalogEvery(config.Catalog.RefreshInterval.Duration)
 	}
-
-	rows, err2 := db.Query(selectUsers)
-	if err2 != nil {
-		panic(err2)
+	openChannels()
+	go expireSupporters(time.Second)
+	if config.Stones.ActiveGrant > 0 {
+		go grantActiveStones(config.Stones.ActiveWindow.Duration)
 	}
-	type row struct {
-		name  string
-		cards []int
+	if config.Chat.Address != "" {
+		go newChatClient(config.Chat, chatRooms()).run()
 	}
-	for rows.Next() {
-		var next row
-		var leaderid int
-		err = rows.Scan(&next.name, &leaderid)
-		next.cards = []int{leaderid}
-		if err != nil {
-			panic(err)
-		}
-		var userCards []UserCard = []UserCard{}
-		for _, id := range next.cards {
-			res, err3 := db.Query("SELECT * from UserCards where key =" + strconv.Itoa(id))
-			if err3 != nil {
-				panic(err3)
-			}
-			for res.Next() {
-				var userCard UserCard
-				err = res.Scan(&userCard.Key, &userCard.Id)
-				if err != nil {
-					panic(err)
-				}
-				userCards = append(userCards, userCard)
-			}
-		}
-		var user User = User{Name: next.name, Box: Box{UserCards: &userCards, Size: len(userCards)}}
-		users.m[user.Name] = user
-	}
-}
-
-func main() {
-	rand.Seed(time.Now().Unix())
-	fmt.Println("Starting server")
-
-	bootstrapDB()
 
 	r := gin.Default()
 	r.LoadHTMLGlob("templates/*")
 	r.Static("/css", "./css")
 	r.Static("/assets", "./assets")
 
+	channelRoutes(r.Group("/", withChannel))
+	channelRoutes(r.Group("/c/:"+channelParam, withChannel))
+
+	r.Run() // listen and serve on 0.0.0.0:8080
+}
+
+// channelRoutes registers every route that is about a single channel.
+func channelRoutes(r *gin.RouterGroup) {
 	// External commands
-	r.GET("/roll", roll)
-	r.GET("/scam", scam)
-	r.GET("/status", status)
-	r.GET("/keep", keep)
-	r.GET("/support", support)
-	r.GET("/shout", shout)
+	ext := r.Group("/", requireBot)
+	for name := range commands {
+		ext.GET("/"+name, httpCommand(name))
+	}
 
 	// Internal commands
 	r.GET("/supports", supports)
 	r.GET("/shouts", shouts)
+	r.GET("/shoutstream", shoutStream)
+	r.GET("/shoutack", shoutAck)
+	r.GET("/rollhistory", rollHistory)
+	r.GET("/ratestats", rateStats)
 
 	// Views
 	r.GET("/viewsupports", viewSupports)
 	r.GET("/viewshouts", viewShouts)
+	r.GET("/viewrates", viewRates)
+	r.GET("/viewhistory", viewRollHistory)
+	r.GET("/viewratestats", viewRateStats)
+
+	// Admin commands
+	admin := r.Group("/admin", requireAdmin)
+	admin.GET("/refresh", refresh)
+	admin.GET("/moderate", viewModerate)
+	admin.GET("/decision", decision)
+	admin.GET("/shouts", viewShoutHistory)
+	admin.GET("/shouthistory", shoutHistory)
+	admin.GET("/replay", replay)
+	admin.GET("/grant", grantStones)
+}
 
-	r.Run() // listen and serve on 0.0.0.0:8080
+func requireAdmin(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.AbortWithStatus(403)
+	}
+}
+
+// isAdmin reports whether the request carries the admin ?token=.
+func isAdmin(ctx *gin.Context) bool {
+	token := ctx.Query("token")
+	return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+func refresh(ctx *gin.Context) {
+	diff, err := refreshCatalog()
+	if err != nil {
+		ctx.JSON(500, gin.H{"error": err.Error(), "diff": diff})
+		return
+	}
+	ctx.JSON(200, diff)
 }
 
 func viewSupports(ctx *gin.Context) {
-	ctx.HTML(200, "viewsupports.tmpl", nil)
+	ctx.HTML(200, "viewsupports.tmpl", gin.H{"Base": channelOf(ctx).base()})
 }
 
 func viewShouts(ctx *gin.Context) {
-	ctx.HTML(200, "viewshouts.tmpl", nil)
+	ch := channelOf(ctx)
+	ctx.HTML(200, "viewshouts.tmpl", gin.H{"Base": ch.base(), "Channel": ch.Name})
 }
 
-func shouts(ctx *gin.Context) {
-	if len(shouters) == 0 {
-		ctx.Status(200)
+func viewRates(ctx *gin.Context) {
+	banner, ok := pickBanner(ctx.Query(bannerParam), time.Now())
+	if !ok {
+		ctx.Status(404)
 		return
 	}
-	s := <-shouters
-	ctx.HTML(200, "shouts.tmpl", gin.H{"Shout": s})
+	c := currentCatalog()
+	ctx.HTML(200, "viewrates.tmpl", gin.H{"Rates": c.poolsFor(banner).rates(), "Banner": banner, "LoadedAt": c.LoadedAt})
 }
 
-func shout(ctx *gin.Context) {
-	user := ctx.Query(userParam)
-	message := ctx.Query(messageParam)
-	if user == "" {
-		ctx.String(200, "Invalid user.")
-		return
-	}
-	users.RLock()
-	userInfo, userExists := users.m[user]
-	users.RUnlock()
-	if !userExists {
-		ctx.String(200, user+" has not been scammed yet.")
-		return
+func showRates(ch *Channel, args url.Values) string {
+	name := args.Get(bannerParam)
+	banner, ok := pickBanner(name, time.Now())
+	if !ok {
+		return "There is no banner called " + name + " running right now."
 	}
-	if len(message) > 100 {
-		ctx.String(200, user+" your message cannot be longer than 100 characters.")
-		return
-	}
-	var shout = ShouterUi{userInfo.Name, (*userInfo.Box.UserCards)[0], message}
-	shouters <- shout
-	ctx.String(200, user+"'s message has been queued.")
+	return formatRates(currentCatalog().poolsFor(banner).rates(), banner)
 }
 
-func supports(ctx *gin.Context) {
-	supporters.RLock()
-	var u = make(map[string]SupporterUi)
-	for user, support := range supporters.m {
-		support.tick()
-		if support.expired() {
-			delete(supporters.m, user)
-		} else {
-			u[user] = support.toUi()
-		}
-	}
-	ctx.HTML(200, "supports.tmpl", gin.H{"Supports": u})
-	supporters.RUnlock()
+func showBanners(ch *Channel, args url.Values) string {
+	return formatBanners(time.Now())
 }
 
-func support(ctx *gin.Context) {
-	user := ctx.Query(userParam)
+func shout(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	message := args.Get(messageParam)
 	if user == "" {
-		ctx.String(200, "Invalid user.")
-		return
+		return "Invalid user."
 	}
-	users.RLock()
-	userInfo, userExists := users.m[user]
-	users.RUnlock()
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
 	if !userExists {
-		ctx.String(200, user+" has not been scammed yet.")
-		return
+		return user + " has not been scammed yet."
 	}
-	supporters.RLock()
-	_, alreadySupporting := supporters.m[user]
-	num := len(supporters.m)
-	supporters.RUnlock()
-	if alreadySupporting {
-		ctx.String(200, user+" is already supporting.")
-		return
+	if len(message) > 100 {
+		return user + " your message cannot be longer than 100 characters."
 	}
-	if num >= 1 {
-		ctx.String(200, "Sweetily has too many supporters right now!")
-		return
+	var shout = ShouterUi{userInfo.Name, userInfo.Box.leader(), message}
+	if reason := ch.filterShout(message); reason != "" {
+		logRejection(shout, "filter", reason)
+		ch.recordShout(shout, outcomeFiltered, reason)
+		return user + "'s message was not allowed."
+	}
+	if ch.Moderation.RequireApproval {
+		id := ch.recordShout(shout, outcomePending, "")
+		_, err := ch.moderation.add(shout, id)
+		if err != nil {
+			return shoutNotQueued(ch, id, shout, err)
+		}
+		return user + "'s message is waiting for a moderator."
+	}
+	id := ch.recordShout(shout, outcomeAccepted, "")
+	place, err := ch.shouts.enqueue(Shout{RecordId: id, ShouterUi: shout})
+	if err != nil {
+		return shoutNotQueued(ch, id, shout, err)
+	}
+	return user + "'s message is #" + strconv.Itoa(place) + " in line."
+}
+
+func shoutNotQueued(ch *Channel, id int, shout ShouterUi, err error) string {
+	if err == errShoutPending {
+		ch.updateShout(id, outcomeDuplicate, shout.Message, "")
+		return shout.Name + " already has a message waiting to be read."
 	}
-	supporters.Lock()
-	supporters.m[user] = &Supporter{userInfo, 12}
-	supporters.Unlock()
-	ctx.String(200, user+" is now supporting Sweetily with "+cards[(*userInfo.Box.UserCards)[0].Id].Name+"!")
+	ch.updateShout(id, outcomeQueueFull, shout.Message, "")
+	return "Sorry " + shout.Name + ", too many messages are waiting right now. Try again later!"
+}
+
+// storeFailed reports a Store error. The in-memory state has not been
+// touched at this point, so it still matches what was committed.
+func storeFailed(user string, err error) string {
+	log.Printf("store: %s: %v", user, err)
+	return "Something went wrong, " + user + "'s box was not changed."
 }
 
-func scam(ctx *gin.Context) {
-	user := ctx.Query(userParam)
+func scam(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
 	if user == "" {
-		ctx.String(200, "Invalid user.")
-		return
+		return "Invalid user."
 	}
-	users.RLock()
-	_, userExists := users.m[user]
-	users.RUnlock()
+	ch.users.RLock()
+	_, userExists := ch.users.m[user]
+	ch.users.RUnlock()
 	if userExists {
-		ctx.String(200, user+" has already been scammed.")
-		return
+		return user + " has already been scammed."
 	}
 
 	var starterId = 1
-	var key int
-	err := db.QueryRow(insertUserCard, starterId).Scan(&key)
+	starter, err := ch.store.CreateUser(user, starterId)
 	if err != nil {
-		panic(err)
+		return storeFailed(user, err)
 	}
-	_, err = db.Exec(insertUser, user, key)
-	if err != nil {
-		panic(err)
+
+	ch.users.Lock()
+	ch.users.m[user] = &User{Name: user, Box: Box{UserCards: []UserCard{starter}, Size: config.BoxSize}}
+	ch.users.Unlock()
+	return user + " has been successfully scammed."
+}
+
+func roll(ch *Channel, args url.Values) string {
+	count := 1
+	if c := args.Get(countParam); c != "" {
+		var err error
+		count, err = strconv.Atoi(c)
+		if err != nil || count < 1 || count > config.MaxRolls {
+			return "You can roll between 1 and " + strconv.Itoa(config.MaxRolls) + " eggs at once."
+		}
 	}
+	return rollMany(ch, args, count)
+}
 
-	users.Lock()
-	users.m[user] = User{user, Box{UserCards: &[]UserCard{UserCard{Key: key, Id: starterId}}, Size: 1}}
-	users.Unlock()
-	ctx.String(200, user+" has been successfully scammed.")
+// roll10 is refused when MaxRolls is below 10, so it cannot get past the
+// cap.
+func roll10(ch *Channel, args url.Values) string {
+	if config.MaxRolls < 10 {
+		return "You can roll between 1 and " + strconv.Itoa(config.MaxRolls) + " eggs at once."
+	}
+	return rollMany(ch, args, 10)
 }
 
-func roll(ctx *gin.Context) {
-	user := ctx.Query(userParam)
+// rollMany rolls count eggs and replaces the user's pending cards with the
+// results, so any of them can be kept afterwards.
+func rollMany(ch *Channel, args url.Values, count int) string {
+	user := args.Get(userParam)
 	if user == "" {
-		ctx.String(200, "Invalid user.")
-		return
+		return "Invalid user."
 	}
-	users.RLock()
-	userInfo, userExists := users.m[user]
-	users.RUnlock()
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
 	if !userExists {
-		ctx.String(200, user+" has not been scammed yet.")
-		return
+		return user + " has not been scammed yet."
 	}
-	// if (len(*userInfo.Box.Cards) > userInfo.Box.Size) {
-	// 	ctx.String(200, user + "'s box space is full.")
-	// 	return
-	// }
-	var roll Card = cards[validIds[rand.Intn(len(validIds))]]
-	var resp = user + "'s roll: " + getEggTier(roll) + " " + roll.Name
-	var newCard UserCard = UserCard{Key: -1, Id: roll.Id}
+	name := args.Get(bannerParam)
+	banner, ok := pickBanner(name, time.Now())
+	if !ok {
+		return "There is no banner called " + name + " running right now."
+	}
+	c := currentCatalog()
 	userInfo.Box.Lock()
-	*userInfo.Box.UserCards = append((*userInfo.Box.UserCards)[0:1], newCard)
+	if userInfo.Box.full() {
+		userInfo.Box.Unlock()
+		return user + "'s box space is full."
+	}
+	cost := count * config.Stones.RollCost
+	if userInfo.Stones < cost {
+		userInfo.Box.Unlock()
+		return notEnoughStones(user, count, userInfo.Stones)
+	}
+	var results = make([]RollResult, count)
+	var records = make([]RollRecord, count)
+	var now = time.Now()
+	var pity = userInfo.Pity
+	for i := range results {
+		guaranteed := pityRolls(pity) == 1
+		roll := rollCard(c, banner, guaranteed)
+		pity = pity + 1
+		if tierIndex(roll) <= pityTier() {
+			pity = 0
+		}
+		results[i] = RollResult{roll, guaranteed}
+		records[i] = RollRecord{Name: user, Card: roll.Id, Tier: getEggTier(roll).Name, Pity: guaranteed, Rolled: now}
+		if banner != nil {
+			records[i].Banner = banner.Name
+		}
+	}
+	stones, err := ch.store.SaveRoll(user, pity, cost, records)
+	if err == errNotEnoughStones {
+		userInfo.Box.Unlock()
+		return notEnoughStones(user, count, userInfo.Stones)
+	}
+	if err != nil {
+		userInfo.Box.Unlock()
+		return storeFailed(user, err)
+	}
+	var pending = make([]PendingCard, count)
+	for i, r := range records {
+		pending[i] = PendingCard{Id: r.Card, Roll: r.Id}
+	}
+	userInfo.Pity = pity
+	userInfo.Stones = stones
+	userInfo.Box.Pending = pending
 	userInfo.Box.Unlock()
-	ctx.String(200, resp)
+
+	return formatRolls(user, banner, results)
 }
 
-func status(ctx *gin.Context) {
-	user := ctx.Query(userParam)
+func status(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
 	if user == "" {
-		ctx.String(200, "Invalid user.")
-		return
+		return "Invalid user."
 	}
-	users.RLock()
-	userInfo, userExists := users.m[user]
-	users.RUnlock()
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
 	if !userExists {
-		ctx.String(200, user+" has not been scammed yet.")
-		return
+		return user + " has not been scammed yet."
 	}
+	cards := currentCatalog().Cards
 	userInfo.Box.RLock()
-	var resp = user + "'s box: ["
-	for i, card := range *userInfo.Box.UserCards {
+	var resp = user + "'s box (" + strconv.Itoa(len(userInfo.Box.UserCards)) + "/" + strconv.Itoa(userInfo.Box.Size) + "): ["
+	for i, card := range userInfo.Box.UserCards {
+		resp = resp + strconv.Itoa(i+1) + ") " + cards[card.Id].Name
 		if i == 0 {
-			resp = resp + cards[card.Id].Name + " (leader)"
-		} else if i == userInfo.Box.Size {
-			resp = resp + cards[card.Id].Name + " (overflow)"
-		} else {
-			resp = resp + cards[card.Id].Name
+			resp = resp + " (leader)"
 		}
-		if i < len(*userInfo.Box.UserCards)-1 {
+		if i < len(userInfo.Box.UserCards)-1 {
 			resp = resp + ", "
 		}
 	}
 	resp = resp + "]"
+	if len(userInfo.Box.Pending) > 0 {
+		resp = resp + ", new: ["
+		for i, card := range userInfo.Box.Pending {
+			resp = resp + strconv.Itoa(i+1) + ") " + cards[card.Id].Name
+			if i < len(userInfo.Box.Pending)-1 {
+				resp = resp + ", "
+			}
+		}
+		resp = resp + "]"
+	}
+	if left := pityRolls(userInfo.Pity); left > 0 {
+		resp = resp + ", " + strconv.Itoa(left) + " rolls until a guaranteed " + config.Tiers[pityTier()].Label
+	}
+	resp = resp + ", " + strconv.Itoa(userInfo.MonsterPoints) + " MP, " + strconv.Itoa(userInfo.Stones) + " stones"
 	userInfo.Box.RUnlock()
-	ctx.String(200, resp)
+	return resp
 }
 
-func keep(ctx *gin.Context) {
-	user := ctx.Query(userParam)
+// keep moves one of the user's pending cards into their box and makes it
+// their leader.
+func keep(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
 	if user == "" {
-		ctx.String(200, "Invalid user.")
-		return
+		return "Invalid user."
 	}
-	users.RLock()
-	userInfo, userExists := users.m[user]
-	users.RUnlock()
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
 	if !userExists {
-		ctx.String(200, user+" has not been scammed yet.")
-		return
+		return user + " has not been scammed yet."
 	}
 	userInfo.Box.Lock()
-	if len(*userInfo.Box.UserCards) < 2 {
-		userInfo.Box.Unlock()
-		ctx.String(200, user+" does not have a new card to keep.")
-		return
-	}
-
-	var key int
-	err := db.QueryRow(insertUserCard, (*userInfo.Box.UserCards)[1].Id).Scan(&key)
-	if err != nil {
-		panic(err)
+	defer userInfo.Box.Unlock()
+	pending := len(userInfo.Box.Pending)
+	if pending < 1 {
+		return user + " does not have a new card to keep."
+	}
+	choice := 1
+	if c := args.Get(cardParam); c != "" {
+		var err error
+		choice, err = strconv.Atoi(c)
+		if err != nil || choice < 1 || choice > pending {
+			return user + " can only keep cards 1 to " + strconv.Itoa(pending) + "."
+		}
+	} else if pending > 1 {
+		return user + " has " + strconv.Itoa(pending) + " new cards, pick one to keep with card=1 to card=" + strconv.Itoa(pending) + "."
 	}
-	_, err = db.Exec(updateUser, key, user)
-	if err != nil {
-		panic(err)
+	if userInfo.Box.full() {
+		return user + "'s box space is full."
 	}
-	_, err = db.Exec(deleteUserCard, (*userInfo.Box.UserCards)[0].Key)
+	picked := userInfo.Box.Pending[choice-1]
+	kept, err := ch.store.KeepCard(user, picked.Id, picked.Roll)
 	if err != nil {
-		panic(err)
+		return storeFailed(user, err)
 	}
 
-	(*userInfo.Box.UserCards)[1].Key = key
-	(*userInfo.Box.UserCards)[0] = (*userInfo.Box.UserCards)[1]
-	*userInfo.Box.UserCards = (*userInfo.Box.UserCards)[:1]
-	var resp = user + "'s new leader is: " + cards[(*userInfo.Box.UserCards)[0].Id].Name
-	userInfo.Box.Unlock()
-	ctx.String(200, resp)
+	userInfo.Box.UserCards = append([]UserCard{kept}, userInfo.Box.UserCards...)
+	userInfo.Box.Pending = append(userInfo.Box.Pending[:choice-1], userInfo.Box.Pending[choice:]...)
+	return user + "'s new leader is: " + currentCatalog().Cards[kept.Id].Name
 }
 
-func getCards() map[int]Card {
-	resp, err := http.Get("https://www.padherder.com/api/monsters/")
-	if err != nil {
-		panic(err.Error())
+// boxSlot reads the card param as a 1-based slot in the user's box, or
+// returns what is wrong with it. The caller must hold the box lock.
+func boxSlot(args url.Values, userInfo *User) (int, string) {
+	slot, err := strconv.Atoi(args.Get(cardParam))
+	if err != nil || slot < 1 || slot > len(userInfo.Box.UserCards) {
+		return 0, userInfo.Name + " can only pick cards 1 to " + strconv.Itoa(len(userInfo.Box.UserCards)) + " from their box."
 	}
+	return slot - 1, ""
+}
 
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-	var allCards []Card
-	err = decoder.Decode(&allCards)
-	if err != nil {
-		panic(err.Error())
+func leader(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
 	}
-
-	ret := make(map[int]Card)
-	for _, card := range filterCards(allCards) {
-		ret[card.Id] = card
-		validIds = append(validIds, card.Id)
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return user + " has not been scammed yet."
 	}
-	return ret
-}
-
-func filterCards(cards []Card) (ret []Card) {
-	for _, card := range cards {
-		if !card.Jp_only {
-			ret = append(ret, card)
-		}
+	userInfo.Box.Lock()
+	defer userInfo.Box.Unlock()
+	i, problem := boxSlot(args, userInfo)
+	if problem != "" {
+		return problem
+	}
+	card := userInfo.Box.UserCards[i]
+	err := ch.store.SetLeader(user, card)
+	if err != nil {
+		return storeFailed(user, err)
 	}
-	return ret
+	copy(userInfo.Box.UserCards[1:i+1], userInfo.Box.UserCards[0:i])
+	userInfo.Box.UserCards[0] = card
+	return user + "'s new leader is: " + currentCatalog().Cards[card.Id].Name
 }
 
-func getEggTier(card Card) string {
-	if card.Monster_points >= 15000 || card.Rarity > 8 {
-		return "DIAMOND EGG!!!"
+func release(ch *Channel, args url.Values) string {
+	user := args.Get(userParam)
+	if user == "" {
+		return "Invalid user."
 	}
-	if card.Monster_points >= 5000 || card.Rarity > 6 {
-		return "GOLD EGG!!"
+	ch.users.RLock()
+	userInfo, userExists := ch.users.m[user]
+	ch.users.RUnlock()
+	if !userExists {
+		return user + " has not been scammed yet."
 	}
-	if card.Monster_points >= 3000 || card.Rarity > 4 {
-		return "SILVER EGG!"
+	userInfo.Box.Lock()
+	defer userInfo.Box.Unlock()
+	i, problem := boxSlot(args, userInfo)
+	if problem != "" {
+		return problem
+	}
+	if i == 0 {
+		return user + " cannot release their leader."
+	}
+	card := userInfo.Box.UserCards[i]
+	err := ch.store.ReleaseCard(user, card)
+	if err != nil {
+		return storeFailed(user, err)
 	}
-	return "BRONZE EGG"
+	userInfo.Box.UserCards = append(userInfo.Box.UserCards[:i], userInfo.Box.UserCards[i+1:]...)
+	return user + " released " + currentCatalog().Cards[card.Id].Name + "."
 }
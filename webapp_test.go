@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoll10KeepsToMaxRolls(t *testing.T) {
+	ch := newTestChannel(t, newMemStore())
+	scam(ch, userArgs("mia"))
+	mia := boxOf(t, ch, "mia")
+
+	if got := roll10(ch, userArgs("mia")); !strings.HasPrefix(got, "mia's 10 rolls: ") {
+		t.Fatalf("roll10 with the default cap: %q", got)
+	}
+	config.MaxRolls = 5
+	if got := roll10(ch, userArgs("mia")); got != "You can roll between 1 and 5 eggs at once." {
+		t.Errorf("roll10 past a cap of 5: %q", got)
+	}
+	if len(mia.Box.Pending) != 10 {
+		t.Errorf("refused roll10 left %d new cards", len(mia.Box.Pending))
+	}
+}